@@ -12,7 +12,10 @@ type Opcode struct {
 	Condition   uint8
 	LowNibble   uint8
 	HighNibble  uint8
-	Cycles      uint8
+	// Cycles is number of clock periods (T states) of the instruction on selected cpu model,
+	// conditional instructions report cycles when condition is false, see TakenCycles
+	Cycles uint8
+	Size   uint8
 }
 
 // conditions
@@ -108,160 +111,417 @@ const (
 	ORI
 	CPI
 	HLT
+
+	// undocumented 8085 instructions
+	DSUB
+	ARHL
+	RDEL
+	LDHI
+	LDSI
+	RSTV
+	SHLX
+	JNK
+	JK
+	LHLX
 )
 
 const BDOS = 0x05
 
+// CPUModel selects instruction set used for decoding
+type CPUModel uint8
+
+const (
+	// I8080 is Intel 8080 including undocumented opcode aliases
+	I8080 CPUModel = iota
+	I8085
+	// Z80 is Zilog Z80, it is executed by separate core
+	Z80
+)
+
+func (model CPUModel) String() string {
+	switch model {
+	case I8085:
+		return "8085"
+	case Z80:
+		return "z80"
+	}
+	return "8080"
+}
+
+func ParseCPUModel(name string) (CPUModel, error) {
+	switch name {
+	case "8080":
+		return I8080, nil
+	case "8085":
+		return I8085, nil
+	case "z80":
+		return Z80, nil
+	default:
+		return I8080, fmt.Errorf("unknown cpu model %q", name)
+	}
+}
+
+// GetInstruction decodes instruction at pc as Intel 8080
 func GetInstruction(memory []byte, pc uint16) *Opcode {
+	return GetModelInstruction(I8080, memory, pc)
+}
+
+// undocumented8080 decodes opcodes which 8080 silicon executes as aliases of documented instructions
+func undocumented8080(code byte, memory []byte, pc uint16) (uint8, string, bool) {
+	switch code {
+	case 0x08, 0x10, 0x18, 0x20, 0x28, 0x30, 0x38:
+		return NOP, "*NOP", true
+	case 0xcb:
+		return JMP, fmt.Sprintf("*JMP 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1])), true
+	case 0xd9:
+		return RET, "*RET", true
+	case 0xdd, 0xed, 0xfd:
+		return CALL, fmt.Sprintf("*CALL 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1])), true
+	}
+	return 0, "", false
+}
+
+// undocumented8085 decodes instructions present on 8085 silicon but missing in Intel documentation
+func undocumented8085(code byte, memory []byte, pc uint16) (uint8, string, bool) {
+	switch code {
+	case 0x08:
+		return DSUB, "DSUB", true
+	case 0x10:
+		return ARHL, "ARHL", true
+	case 0x18:
+		return RDEL, "RDEL", true
+	case 0x28:
+		return LDHI, fmt.Sprintf("LDHI 0x%x", memory[pc+1]), true
+	case 0x38:
+		return LDSI, fmt.Sprintf("LDSI 0x%x", memory[pc+1]), true
+	case 0xcb:
+		return RSTV, "RSTV", true
+	case 0xd9:
+		return SHLX, "SHLX", true
+	case 0xdd:
+		return JNK, fmt.Sprintf("JNK 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1])), true
+	case 0xed:
+		return LHLX, "LHLX", true
+	case 0xfd:
+		return JK, fmt.Sprintf("JK 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1])), true
+	}
+	return 0, "", false
+}
+
+// instructionCycles returns clock periods of 8080 or 8085 instruction when its condition is false
+func instructionCycles(model CPUModel, code byte) uint8 {
+	if model == I8085 {
+		return cycles8085(code)
+	}
+	return cycles8080(code)
+}
+
+// TakenCycles returns clock periods of conditional call, return or jump when its condition
+// is met, it is 0 for other instructions
+func TakenCycles(model CPUModel, code byte) uint8 {
+	if model == I8085 {
+		switch {
+		case code == 0xcb:
+			return 12 // RSTV
+		case code == 0xdd, code == 0xfd:
+			return 10 // JNK, JK
+		case code&0xc7 == 0xc0:
+			return 12
+		case code&0xc7 == 0xc2:
+			return 10
+		case code&0xc7 == 0xc4:
+			return 18
+		}
+		return 0
+	}
+
+	switch code & 0xc7 {
+	case 0xc0:
+		return 11
+	case 0xc2:
+		return 10
+	case 0xc4:
+		return 17
+	}
+	return 0
+}
+
+// cycles8080 returns number of T states of 8080 instruction including undocumented aliases
+func cycles8080(code byte) uint8 {
+	switch code {
+	case 0x22, 0x2a:
+		return 16
+	case 0x32, 0x3a:
+		return 13
+	case 0x34, 0x35, 0x36:
+		return 10
+	case 0x76:
+		return 7
+	case 0xc3, 0xc9, 0xcb, 0xd9, 0xd3, 0xdb:
+		return 10
+	case 0xcd, 0xdd, 0xed, 0xfd:
+		return 17
+	case 0xe3:
+		return 18
+	case 0xe9, 0xf9:
+		return 5
+	case 0xeb, 0xf3, 0xfb:
+		return 4
+	}
+
+	switch {
+	case code <= 0x3f:
+		switch code & 0x7 {
+		case 0x1:
+			return 10 // LXI, DAD
+		case 0x2:
+			return 7 // STAX, LDAX
+		case 0x3, 0x4, 0x5:
+			return 5 // INX, DCX, INR, DCR
+		case 0x6:
+			return 7 // MVI
+		}
+		return 4
+	case code <= 0x7f:
+		if code&0x7 == 0x6 || code&0x38 == 0x30 {
+			return 7 // MOV with memory
+		}
+		return 5
+	case code <= 0xbf:
+		if code&0x7 == 0x6 {
+			return 7
+		}
+		return 4
+	}
+
+	switch code & 0x7 {
+	case 0x0:
+		return 5 // conditional return
+	case 0x1:
+		return 10 // POP
+	case 0x2:
+		return 10 // conditional jump
+	case 0x4:
+		return 11 // conditional call
+	case 0x5:
+		return 11 // PUSH
+	case 0x6:
+		return 7 // immediate ALU
+	case 0x7:
+		return 11 // RST
+	}
+	return 4
+}
+
+// cycles8085 returns number of T states of 8085 instruction including undocumented ones
+func cycles8085(code byte) uint8 {
+	switch code {
+	case 0x08, 0x18, 0x28, 0x38, 0xd9, 0xed:
+		return 10 // DSUB, RDEL, LDHI, LDSI, SHLX, LHLX
+	case 0x10:
+		return 7 // ARHL
+	case 0xcb:
+		return 6 // RSTV
+	case 0xdd, 0xfd:
+		return 7 // JNK, JK
+	case 0x22, 0x2a, 0xe3:
+		return 16
+	case 0x32, 0x3a:
+		return 13
+	case 0x34, 0x35, 0x36:
+		return 10
+	case 0x76:
+		return 5
+	case 0xc3, 0xc9, 0xd3, 0xdb:
+		return 10
+	case 0xcd:
+		return 18
+	case 0xe9, 0xf9:
+		return 6
+	}
+
+	switch {
+	case code <= 0x3f:
+		switch code & 0x7 {
+		case 0x1:
+			return 10 // LXI, DAD
+		case 0x2:
+			return 7 // STAX, LDAX
+		case 0x3:
+			return 6 // INX, DCX
+		case 0x6:
+			return 7 // MVI
+		}
+		return 4
+	case code <= 0x7f:
+		if code&0x7 == 0x6 || code&0x38 == 0x30 {
+			return 7 // MOV with memory
+		}
+		return 4
+	case code <= 0xbf:
+		if code&0x7 == 0x6 {
+			return 7
+		}
+		return 4
+	}
+
+	switch code & 0x7 {
+	case 0x0:
+		return 6 // conditional return
+	case 0x1:
+		return 10 // POP
+	case 0x2:
+		return 7 // conditional jump
+	case 0x4:
+		return 9 // conditional call
+	case 0x5:
+		return 12 // PUSH
+	case 0x6:
+		return 7 // immediate ALU
+	case 0x7:
+		return 12 // RST
+	}
+	return 4
+}
+
+func GetModelInstruction(model CPUModel, memory []byte, pc uint16) *Opcode {
+	if model == Z80 {
+		return GetZ80Instruction(memory, pc)
+	}
+
 	var instruction uint8
 	var name string
-	var cycles uint8
 
 	code := memory[pc]
 	lowNibble := code & 0x0f
 	highNibble := (code & 0xf0) >> 4
 
+	undocumented := undocumented8080
+	if model == I8085 {
+		undocumented = undocumented8085
+	}
+
+	if instruction, name, ok := undocumented(code, memory, pc); ok {
+		return &Opcode{
+			Code:        code,
+			Name:        name,
+			Instruction: instruction,
+			LowNibble:   lowNibble,
+			HighNibble:  highNibble,
+			Cycles:      instructionCycles(model, code),
+			Size:        InstructionSize(model, code),
+		}
+	}
+
 	switch code {
 	case 0x00:
 		instruction = NOP
 		name = "NOP"
-		cycles = 1
 	case 0x07:
 		instruction = RLC
 		name = "RLC"
-		cycles = 1
 	case 0x0f:
 		instruction = RRC
 		name = "RRC"
-		cycles = 1
 	case 0x17:
 		instruction = RAL
 		name = "RAL"
-		cycles = 1
 	case 0x1f:
 		instruction = RAR
 		name = "RAR"
-		cycles = 1
 	case 0x20:
 		instruction = RIM
 		name = "RIM"
-		cycles = 1
 	case 0x22:
 		instruction = SHLD
 		name = fmt.Sprintf("SHLD 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1]))
-		cycles = 5
 	case 0x27:
 		instruction = DAA
 		name = "DAA"
-		cycles = 1
 	case 0x2a:
 		instruction = LHLD
 		name = fmt.Sprintf("LHLD 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1]))
-		cycles = 5
+	case 0x76:
+		instruction = HLT
+		name = "HLT"
 	case 0x2f:
 		instruction = CMA
 		name = "CMA"
-		cycles = 1
 	case 0x30:
 		instruction = SIM
 		name = "SIM"
-		cycles = 0
 	case 0x32:
 		instruction = STA
 		name = fmt.Sprintf("STA 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1]))
-		cycles = 4
 	case 0x37:
 		instruction = STC
 		name = "STC"
-		cycles = 1
 	case 0x3a:
 		instruction = LDA
 		name = fmt.Sprintf("LDA 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1]))
-		cycles = 4
 	case 0x3f:
 		instruction = CMC
 		name = "CMC"
-		cycles = 5
 	case 0xc0:
 		instruction = RNZ
 		name = "RNZ"
-		cycles = 3
 	case 0xc2:
 		instruction = JNZ
 		name = "JNZ"
-		cycles = 3
 	case 0xc3:
 		instruction = JMP
 		name = "JMP"
-		cycles = 3
 	case 0xc4:
 		instruction = CNZ
 		name = "CNZ"
-		cycles = 3
 	case 0xc8:
 		instruction = RZ
 		name = "RZ"
-		cycles = 5
 	case 0xc9:
 		instruction = RET
 		name = "RET"
-		cycles = 3
 	case 0xca:
 		instruction = JZ
 		name = "JZ"
-		cycles = 3
 	case 0xcc:
 		instruction = CZ
 		name = "CZ"
-		cycles = 3
 	case 0xcd:
 		instruction = CALL
 		name = fmt.Sprintf("CALL 0x%x", misc.Make16bit(memory[pc+2], memory[pc+1]))
-		cycles = 5
 	case 0xd0:
 		instruction = RNC
 		name = "RNC"
-		cycles = 3
 	case 0xd2:
 		instruction = JNC
 		name = "JNC"
-		cycles = 3
 	case 0xd3:
 		instruction = OUT
 		name = "OUT"
-		cycles = 3
 	case 0xd4:
 		instruction = CNC
 		name = "CNC"
-		cycles = 3
 	case 0xd8:
 		instruction = RC
 		name = "RC"
-		cycles = 5
 	case 0xda:
 		instruction = JC
 		name = "JC"
-		cycles = 3
 	case 0xdb:
 		instruction = IN
 		name = "IN"
-		cycles = 3
 	case 0xdc:
 		instruction = CC
 		name = "CC"
-		cycles = 3
 	case 0xe0:
 		instruction = RPO
 		name = "RPO"
-		cycles = 5
 	case 0xe2:
 		instruction = JPO
 		name = "JPO"
-		cycles = 3
 	case 0xe3:
 		instruction = XTHL
 		name = "XTHL"
-		cycles = 5
 	case 0xe4:
 		instruction = CPO
 		name = "CPO"
@@ -269,172 +529,119 @@ func GetInstruction(memory []byte, pc uint16) *Opcode {
 	case 0xe8:
 		instruction = RPE
 		name = "RPE"
-		cycles = 5
 	case 0xe9:
 		instruction = PCHL
 		name = "PCHL"
-		cycles = 5
 	case 0xea:
 		instruction = JPE
 		name = "JPE"
-		cycles = 3
 	case 0xeb:
 		instruction = XCHG
 		name = "XCHG"
-		cycles = 1
 	case 0xec:
 		instruction = CPE
 		name = "CPE"
-		cycles = 3
 	case 0xf0:
 		instruction = RP
 		name = "RP"
-		cycles = 5
 	case 0xf2:
 		instruction = JP
 		name = "JP"
-		cycles = 3
 	case 0xf3:
 		instruction = DI
 		name = "DI"
-		cycles = 1
 	case 0xf4:
 		instruction = CP
 		name = "CP"
-		cycles = 3
 	case 0xf8:
 		instruction = RM
 		name = "RM"
-		cycles = 5
 	case 0xf9:
 		instruction = SPHL
 		name = "SPHL"
-		cycles = 5
 	case 0xfa:
 		instruction = JM
 		name = "JM"
-		cycles = 3
 	case 0xfb:
 		instruction = EI
 		name = "EI"
-		cycles = 1
 	case 0xfc:
 		instruction = CM
 		name = "CM"
-		cycles = 3
 	default:
 
 		if code >= 0x01 && code <= 0x31 && code&0xF == 0x1 {
 			instruction = LXI
 			name = fmt.Sprintf("LXI %s, 0x%x", misc.RegPairToString(highNibble), misc.Make16bit(memory[pc+2], memory[pc+1]))
-			cycles = 3
 		} else if code >= 0x02 && code <= 0x12 && code&0xF == 0x2 {
 			instruction = STAX
 			name = fmt.Sprintf("STAX %s, 0x%x", misc.RegPairToString(highNibble), misc.Make16bit(memory[pc+2], memory[pc+1]))
-			cycles = 2
 		} else if code >= 0x03 && code <= 0x33 && code&0xF == 0x3 {
 			name = fmt.Sprintf("INX %s", misc.RegPairToString(highNibble))
 			instruction = INX
-			cycles = 2
 		} else if code >= 0x04 && code <= 0x3c && (code&0xF == 0x4 || code&0xf == 0xc) {
 			name = fmt.Sprintf("INR %s", misc.RegToString(code>>3))
 			instruction = INR
-			cycles = 1
 		} else if code >= 0x05 && code <= 0x3d && (code&0xf == 0xd || code&0xf == 0x5) {
 			name = "DCR"
 			name = fmt.Sprintf("DCR %s", misc.RegToString(code>>3))
 			instruction = DCR
-			cycles = 1
 		} else if code >= 0x06 && code <= 0x3e && (code&0xf == 0x6 || code&0xf == 0xe) {
 			name = fmt.Sprintf("MVI %s 0x%x", misc.RegToString(code>>3), memory[pc+1])
 			instruction = MVI
 		} else if code >= 0x09 && code <= 0x39 && code&0xf == 0x9 {
 			name = fmt.Sprintf("DAD %s", misc.RegPairToString(highNibble))
 			instruction = DAD
-			cycles = 3
 		} else if code >= 0x0a && code <= 0x1a && code&0xf == 0xa {
 			name = fmt.Sprintf("LDAX %s", misc.RegPairToString(highNibble))
 			instruction = LDAX
-			cycles = 2
 		} else if code >= 0x0b && code <= 0x3b && code&0xf == 0xb {
 			name = fmt.Sprintf("DCX %s", misc.RegPairToString(highNibble))
 			instruction = DCX
-			cycles = 1
 		} else if code >= 0x40 && 0x7f >= code && code != 0x76 {
 
 			name = fmt.Sprintf("MOV %s, %s", misc.RegToString(code>>3), misc.RegToString(code&0b111))
 			instruction = MOV
-			if ((code>>3)&0xf0) == 0b110 || uint8(code) == 0b110 {
-				cycles = 2
-			} else {
-				cycles = 1
-			}
-			cycles = 3
 		} else if code >= 0x80 && code <= 0x87 {
 
 			name = fmt.Sprintf("ADD %s", misc.RegToString(lowNibble))
 			instruction = ADD
-			if uint8(code) == 0b110 {
-				cycles = 2
-			} else {
-				cycles = 1
-			}
 
 		} else if code >= 0x88 && code <= 0x8f {
 
 			name = "ADC"
 			name = fmt.Sprintf("ADC %s", misc.RegToString(lowNibble))
-			if uint8(code) == 0b110 {
-				cycles = 2
-			} else {
-				cycles = 1
-			}
 
 			instruction = ADC
 		} else if code >= 0x90 && code <= 0x97 {
 
 			name = fmt.Sprintf("SUB %s", misc.RegToString(lowNibble))
 			instruction = SUB
-			if uint8(code) == 0b110 {
-				cycles = 2
-			} else {
-				cycles = 1
-			}
 
 		} else if code >= 0x98 && code <= 0x9f {
 
 			name = fmt.Sprintf("SBB %s", misc.RegToString(lowNibble))
 			instruction = SBB
-			if uint8(code) == 0b110 {
-				cycles = 2
-			} else {
-				cycles = 1
-			}
 
 		} else if code >= 0xa0 && code <= 0xa7 {
 
 			name = fmt.Sprintf("ANA %s", misc.RegToString(lowNibble))
 			instruction = ANA
-			cycles = 2
 		} else if code >= 0xa8 && code <= 0xaf {
 			name = fmt.Sprintf("XRA %s", misc.RegToString(lowNibble))
 			instruction = XRA
-			cycles = 2
 		} else if code >= 0xb0 && code <= 0xb7 {
 			name = fmt.Sprintf("ORA %s", misc.RegToString(lowNibble))
 			instruction = ORA
-			cycles = 2
 		} else if code >= 0xb8 && code <= 0xbf {
 			name = fmt.Sprintf("CMP %s", misc.RegToString(lowNibble))
 			instruction = CMP
-			cycles = 2
 		} else if code >= 0xc1 && code <= 0xf1 && code&0xf == 0x1 {
 			if code == 0xf1 {
 				name = "POP PSW"
 			} else {
 				name = fmt.Sprintf("POP %s", misc.RegPairToString(highNibble))
 			}
-			cycles = 3
 			instruction = POP
 		} else if code >= 0xc5 && code <= 0xf5 && code&0xf == 0x5 {
 			if code == 0xf5 {
@@ -442,7 +649,6 @@ func GetInstruction(memory []byte, pc uint16) *Opcode {
 			} else {
 				name = fmt.Sprintf("PUSH %s", misc.RegPairToString(highNibble))
 			}
-			cycles = 3
 			instruction = PUSH
 		} else if code >= 0xc6 && code <= 0xfe && (code&0xf == 0x6 || code&0xf == 0xe) {
 
@@ -454,13 +660,11 @@ func GetInstruction(memory []byte, pc uint16) *Opcode {
 				0xc6: "ADI", 0xce: "ACI", 0xd6: "SUI", 0xde: "SBI", 0xe6: "ANI",
 				0xee: "XRI", 0xf6: "ORI", 0xfe: "CPI",
 			}
-			cycles = 2
 			name = fmt.Sprintf("%s 0x%0x", names[code], memory[pc+1])
 			instruction = instructs[code]
 		} else if code >= 0xc7 && code <= 0xff && (code&0xf == 0x7 || code&0xf == 0xf) {
 			name = "RST"
 			instruction = RST
-			cycles = 3
 		}
 	}
 	opcode := &Opcode{
@@ -469,7 +673,8 @@ func GetInstruction(memory []byte, pc uint16) *Opcode {
 		Instruction: instruction,
 		LowNibble:   lowNibble,
 		HighNibble:  highNibble,
-		Cycles:      cycles,
+		Cycles:      instructionCycles(model, code),
+		Size:        InstructionSize(model, code),
 	}
 	if (code != 0xd9 && code != 0xcb) && (code >= 0xc0 && code <= 0xff) && (string(opcode.Name[0]) == "J" || string(opcode.Name[0]) == "R" || string(opcode.Name[0]) == "C") {
 		setConditionOpcode(opcode)
@@ -477,6 +682,47 @@ func GetInstruction(memory []byte, pc uint16) *Opcode {
 	return opcode
 }
 
+// InstructionSize returns length of instruction in bytes including operands
+func InstructionSize(model CPUModel, code byte) uint8 {
+	if model == I8080 {
+		switch code {
+		case 0xcb, 0xdd, 0xed, 0xfd:
+			return 3
+		}
+	} else {
+		switch code {
+		case 0x28, 0x38:
+			return 2
+		case 0xdd, 0xfd:
+			return 3
+		}
+	}
+
+	switch code {
+	case 0x22, 0x2a, 0x32, 0x3a,
+		0xc2, 0xc3, 0xc4, 0xca, 0xcc, 0xcd,
+		0xd2, 0xd4, 0xda, 0xdc,
+		0xe2, 0xe4, 0xea, 0xec,
+		0xf2, 0xf4, 0xfa, 0xfc:
+		return 3
+	case 0xd3, 0xdb:
+		return 2
+	}
+
+	if code <= 0x3f {
+		if code&0xf == 0x1 {
+			return 3
+		}
+		if code&0x7 == 0x6 {
+			return 2
+		}
+	} else if code >= 0xc0 && code&0x7 == 0x6 {
+		return 2
+	}
+
+	return 1
+}
+
 func setConditionOpcode(opcode *Opcode) {
 	condition := strConditionToByte(string(opcode.Name[1:]))
 	if condition == NotZero || condition == Zero || condition == NoCarry || condition == Carry || condition == ParityOdd || condition == ParityEven || condition == Minus || condition == Positive {
@@ -0,0 +1,382 @@
+package decoder
+
+import (
+	misc "cpu-emulator/utils"
+	"fmt"
+)
+
+var (
+	z80Regs   = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	z80Pairs  = [4]string{"BC", "DE", "HL", "SP"}
+	z80Pairs2 = [4]string{"BC", "DE", "HL", "AF"}
+	z80Conds  = [8]string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+	z80Alu    = [8]string{"ADD A, ", "ADC A, ", "SUB ", "SBC A, ", "AND ", "XOR ", "OR ", "CP "}
+	z80Rot    = [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+	z80Modes  = [8]string{"0", "0", "1", "2", "0", "0", "1", "2"}
+	z80Block  = [4][4]string{
+		{"LDI", "CPI", "INI", "OUTI"},
+		{"LDD", "CPD", "IND", "OUTD"},
+		{"LDIR", "CPIR", "INIR", "OTIR"},
+		{"LDDR", "CPDR", "INDR", "OTDR"},
+	}
+)
+
+// z80Disasm reads one instruction, index is set after DD/FD prefix
+type z80Disasm struct {
+	memory []byte
+	pc     uint16
+	index  string
+	// extra cycles of (IX+d) memory access
+	extra uint8
+}
+
+// GetZ80Instruction decodes instruction at pc as Zilog Z80 including prefixed tables.
+// Conditional instructions report cycles when condition is false
+func GetZ80Instruction(memory []byte, pc uint16) *Opcode {
+	d := &z80Disasm{memory: memory, pc: pc}
+	code := memory[pc]
+	name, cycles := d.decode()
+	return &Opcode{
+		Code:   code,
+		Name:   name,
+		Cycles: cycles,
+		Size:   uint8(d.pc - pc),
+	}
+}
+
+func (d *z80Disasm) next() uint8 {
+	b := d.memory[d.pc]
+	d.pc++
+	return b
+}
+
+func (d *z80Disasm) imm16() uint16 {
+	lsb := d.next()
+	return misc.Make16bit(d.next(), lsb)
+}
+
+func (d *z80Disasm) rel() uint16 {
+	disp := int8(d.next())
+	return d.pc + uint16(disp)
+}
+
+func (d *z80Disasm) indexed() string {
+	disp := int8(d.next())
+	if disp < 0 {
+		return fmt.Sprintf("(%s-0x%x)", d.index, -int(disp))
+	}
+	return fmt.Sprintf("(%s+0x%x)", d.index, disp)
+}
+
+// reg returns name of 8 bit register, H, L and (HL) are replaced after index prefix
+func (d *z80Disasm) reg(i uint8) string {
+	if d.index == "" {
+		return z80Regs[i]
+	}
+	switch i {
+	case 4:
+		return d.index + "H"
+	case 5:
+		return d.index + "L"
+	case 6:
+		d.extra = 8
+		return d.indexed()
+	}
+	return z80Regs[i]
+}
+
+func (d *z80Disasm) pair(p uint8) string {
+	if p == 2 && d.index != "" {
+		return d.index
+	}
+	return z80Pairs[p]
+}
+
+func (d *z80Disasm) pair2(p uint8) string {
+	if p == 2 && d.index != "" {
+		return d.index
+	}
+	return z80Pairs2[p]
+}
+
+func (d *z80Disasm) hl() string {
+	if d.index != "" {
+		return d.index
+	}
+	return "HL"
+}
+
+func (d *z80Disasm) decode() (string, uint8) {
+	code := d.next()
+	switch code {
+	case 0xcb:
+		return d.decodeCB()
+	case 0xed:
+		return d.decodeED()
+	case 0xdd, 0xfd:
+		// prefix followed by another prefix acts as NOP
+		switch d.memory[d.pc] {
+		case 0xdd, 0xed, 0xfd:
+			return "NOP*", 4
+		}
+		d.index = "IX"
+		if code == 0xfd {
+			d.index = "IY"
+		}
+		if d.memory[d.pc] == 0xcb {
+			d.pc++
+			return d.decodeIndexedCB()
+		}
+		name, cycles := d.decodeMain(d.next())
+		return name, cycles + d.extra + 4
+	}
+	return d.decodeMain(code)
+}
+
+func (d *z80Disasm) decodeMain(code uint8) (string, uint8) {
+	x, y, z := code>>6, code>>3&7, code&7
+	p, q := y>>1, y&1
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				return "NOP", 4
+			case 1:
+				return "EX AF, AF'", 4
+			case 2:
+				return fmt.Sprintf("DJNZ 0x%x", d.rel()), 8
+			case 3:
+				return fmt.Sprintf("JR 0x%x", d.rel()), 12
+			}
+			return fmt.Sprintf("JR %s, 0x%x", z80Conds[y-4], d.rel()), 7
+		case 1:
+			if q == 0 {
+				return fmt.Sprintf("LD %s, 0x%x", d.pair(p), d.imm16()), 10
+			}
+			return fmt.Sprintf("ADD %s, %s", d.hl(), d.pair(p)), 11
+		case 2:
+			switch y {
+			case 0:
+				return "LD (BC), A", 7
+			case 1:
+				return "LD A, (BC)", 7
+			case 2:
+				return fmt.Sprintf("LD (0x%x), %s", d.imm16(), d.hl()), 16
+			case 3:
+				return fmt.Sprintf("LD %s, (0x%x)", d.hl(), d.imm16()), 16
+			case 4:
+				return "LD (DE), A", 7
+			case 5:
+				return "LD A, (DE)", 7
+			case 6:
+				return fmt.Sprintf("LD (0x%x), A", d.imm16()), 13
+			}
+			return fmt.Sprintf("LD A, (0x%x)", d.imm16()), 13
+		case 3:
+			if q == 0 {
+				return "INC " + d.pair(p), 6
+			}
+			return "DEC " + d.pair(p), 6
+		case 4:
+			if y == 6 {
+				return "INC " + d.reg(y), 11
+			}
+			return "INC " + d.reg(y), 4
+		case 5:
+			if y == 6 {
+				return "DEC " + d.reg(y), 11
+			}
+			return "DEC " + d.reg(y), 4
+		case 6:
+			if y == 6 {
+				reg := d.reg(y)
+				if d.index != "" {
+					return fmt.Sprintf("LD %s, 0x%x", reg, d.next()), 7
+				}
+				return fmt.Sprintf("LD %s, 0x%x", reg, d.next()), 10
+			}
+			return fmt.Sprintf("LD %s, 0x%x", d.reg(y), d.next()), 7
+		}
+		return [8]string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}[y], 4
+	case 1:
+		if y == 6 && z == 6 {
+			return "HALT", 4
+		}
+		if y == 6 || z == 6 {
+			// H and L are not replaced when (IX+d) is used
+			mem := d.reg(6)
+			if y == 6 {
+				return fmt.Sprintf("LD %s, %s", mem, z80Regs[z]), 7
+			}
+			return fmt.Sprintf("LD %s, %s", z80Regs[y], mem), 7
+		}
+		return fmt.Sprintf("LD %s, %s", d.reg(y), d.reg(z)), 4
+	case 2:
+		if z == 6 {
+			return z80Alu[y] + d.reg(z), 7
+		}
+		return z80Alu[y] + d.reg(z), 4
+	}
+
+	switch z {
+	case 0:
+		return "RET " + z80Conds[y], 5
+	case 1:
+		if q == 0 {
+			return "POP " + d.pair2(p), 10
+		}
+		switch p {
+		case 0:
+			return "RET", 10
+		case 1:
+			return "EXX", 4
+		case 2:
+			return fmt.Sprintf("JP (%s)", d.hl()), 4
+		}
+		return "LD SP, " + d.hl(), 6
+	case 2:
+		return fmt.Sprintf("JP %s, 0x%x", z80Conds[y], d.imm16()), 10
+	case 3:
+		switch y {
+		case 0:
+			return fmt.Sprintf("JP 0x%x", d.imm16()), 10
+		case 2:
+			return fmt.Sprintf("OUT (0x%x), A", d.next()), 11
+		case 3:
+			return fmt.Sprintf("IN A, (0x%x)", d.next()), 11
+		case 4:
+			return fmt.Sprintf("EX (SP), %s", d.hl()), 19
+		case 5:
+			return "EX DE, HL", 4
+		case 6:
+			return "DI", 4
+		case 7:
+			return "EI", 4
+		}
+	case 4:
+		return fmt.Sprintf("CALL %s, 0x%x", z80Conds[y], d.imm16()), 10
+	case 5:
+		if q == 0 {
+			return "PUSH " + d.pair2(p), 11
+		}
+		if p == 0 {
+			return fmt.Sprintf("CALL 0x%x", d.imm16()), 17
+		}
+	case 6:
+		return fmt.Sprintf("%s0x%x", z80Alu[y], d.next()), 7
+	case 7:
+		return fmt.Sprintf("RST 0x%x", y*8), 11
+	}
+	// prefixes are handled by decode
+	return "???", 4
+}
+
+func (d *z80Disasm) decodeCB() (string, uint8) {
+	code := d.next()
+	x, y, z := code>>6, code>>3&7, code&7
+
+	cycles := uint8(8)
+	if z == 6 {
+		cycles = 15
+		if x == 1 {
+			cycles = 12
+		}
+	}
+
+	switch x {
+	case 0:
+		return fmt.Sprintf("%s %s", z80Rot[y], z80Regs[z]), cycles
+	case 1:
+		return fmt.Sprintf("BIT %d, %s", y, z80Regs[z]), cycles
+	case 2:
+		return fmt.Sprintf("RES %d, %s", y, z80Regs[z]), cycles
+	}
+	return fmt.Sprintf("SET %d, %s", y, z80Regs[z]), cycles
+}
+
+// decodeIndexedCB decodes DD CB d op and FD CB d op, displacement comes before opcode
+func (d *z80Disasm) decodeIndexedCB() (string, uint8) {
+	mem := d.indexed()
+	code := d.next()
+	x, y, z := code>>6, code>>3&7, code&7
+
+	// result is also copied to register unless z is 6
+	copyTo := ""
+	if z != 6 && x != 1 {
+		copyTo = ", " + z80Regs[z]
+	}
+
+	switch x {
+	case 0:
+		return fmt.Sprintf("%s %s%s", z80Rot[y], mem, copyTo), 23
+	case 1:
+		return fmt.Sprintf("BIT %d, %s", y, mem), 20
+	case 2:
+		return fmt.Sprintf("RES %d, %s%s", y, mem, copyTo), 23
+	}
+	return fmt.Sprintf("SET %d, %s%s", y, mem, copyTo), 23
+}
+
+func (d *z80Disasm) decodeED() (string, uint8) {
+	code := d.next()
+	x, y, z := code>>6, code>>3&7, code&7
+	p, q := y>>1, y&1
+
+	if x == 2 && z <= 3 && y >= 4 {
+		return z80Block[y-4][z], 16
+	}
+	if x != 1 {
+		return "NOP*", 8
+	}
+
+	switch z {
+	case 0:
+		if y == 6 {
+			return "IN (C)", 12
+		}
+		return fmt.Sprintf("IN %s, (C)", z80Regs[y]), 12
+	case 1:
+		if y == 6 {
+			return "OUT (C), 0", 12
+		}
+		return fmt.Sprintf("OUT (C), %s", z80Regs[y]), 12
+	case 2:
+		if q == 0 {
+			return "SBC HL, " + z80Pairs[p], 15
+		}
+		return "ADC HL, " + z80Pairs[p], 15
+	case 3:
+		if q == 0 {
+			return fmt.Sprintf("LD (0x%x), %s", d.imm16(), z80Pairs[p]), 20
+		}
+		return fmt.Sprintf("LD %s, (0x%x)", z80Pairs[p], d.imm16()), 20
+	case 4:
+		return "NEG", 8
+	case 5:
+		if y == 1 {
+			return "RETI", 14
+		}
+		return "RETN", 14
+	case 6:
+		return "IM " + z80Modes[y], 8
+	}
+
+	switch y {
+	case 0:
+		return "LD I, A", 9
+	case 1:
+		return "LD R, A", 9
+	case 2:
+		return "LD A, I", 9
+	case 3:
+		return "LD A, R", 9
+	case 4:
+		return "RRD", 18
+	case 5:
+		return "RLD", 18
+	}
+	return "NOP*", 8
+}
@@ -0,0 +1,74 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+)
+
+// Device is peripheral attached to IN/OUT ports. Device returns 0 from ports it doesn't drive
+type Device interface {
+	In(port uint8) uint8
+	Out(port uint8, val uint8)
+}
+
+// PortAccess is single IN or OUT seen on the bus
+type PortAccess struct {
+	Port uint8
+	Val  uint8
+	Out  bool
+}
+
+func (access PortAccess) String() string {
+	if access.Out {
+		return fmt.Sprintf("OUT 0x%02x <- 0x%02x", access.Port, access.Val)
+	}
+	return fmt.Sprintf("IN  0x%02x -> 0x%02x", access.Port, access.Val)
+}
+
+// Bus dispatches port accesses to devices mapped on port ranges. Several devices
+// can share a port: all of them receive OUT and values they return on IN are ORed.
+// Bus is Device itself, so buses can be nested
+type Bus struct {
+	ports [256][]Device
+
+	// Trace is called after every port access
+	Trace func(access PortAccess)
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Map attaches device to ports in range [first, last]
+func (bus *Bus) Map(first, last uint8, dev Device) {
+	for port := int(first); port <= int(last); port++ {
+		bus.ports[port] = append(bus.ports[port], dev)
+	}
+}
+
+// TraceTo writes every port access to w
+func (bus *Bus) TraceTo(w io.Writer) {
+	bus.Trace = func(access PortAccess) {
+		fmt.Fprintln(w, access)
+	}
+}
+
+func (bus *Bus) In(port uint8) uint8 {
+	var val uint8
+	for _, dev := range bus.ports[port] {
+		val |= dev.In(port)
+	}
+	if bus.Trace != nil {
+		bus.Trace(PortAccess{Port: port, Val: val})
+	}
+	return val
+}
+
+func (bus *Bus) Out(port uint8, val uint8) {
+	for _, dev := range bus.ports[port] {
+		dev.Out(port, val)
+	}
+	if bus.Trace != nil {
+		bus.Trace(PortAccess{Port: port, Val: val, Out: true})
+	}
+}
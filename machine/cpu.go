@@ -5,7 +5,7 @@ import (
 	misc "cpu-emulator/utils"
 	"fmt"
 	"math/bits"
-	"os"
+	"sync"
 )
 
 type Cpu struct {
@@ -18,22 +18,45 @@ type Cpu struct {
 	sp uint16 // stack pointer
 	pc uint16 //  program counter
 
-	IO_handler IO_handler
-	Ports      Ports
+	// IO receives IN and OUT, usually it is Bus with devices mapped on it
+	IO Device
+
+	// Model selects instruction set, 8080 with undocumented aliases by default
+	Model decoder.CPUModel
+	i8085 intel8085
 
 	InterruptEnabled bool
+	// eiDelay is set by EI, interrupt is not accepted until the next instruction completes
+	eiDelay bool
+	// irq is instruction put on data bus by pending interrupt request, nil if none
+	irq []byte
+	// busOp is set while instruction from data bus is executed during acknowledge
+	busOp []byte
+	// InterruptAck is called when cpu acknowledges pending interrupt,
+	// interrupt controller can use it to update its in-service state
+	InterruptAck func()
+
+	// halted is set by HLT, cpu does nothing until interrupt arrives
+	halted bool
+	// cycles are clock periods taken by the last Step
+	cycles int
+	// fault is set by instruction which can't be completed and is returned from Step
+	fault error
+
+	Profiler *Profiler
+
+	pokes    []poke
+	pokeLock sync.Mutex
+	// snapshot is pending request of another goroutine, served between instructions
+	snapshot *memSnapshot
 }
 
 func InitCpu() *Cpu {
-	cpu := &Cpu{
+	return &Cpu{
 		memory: &Memory{},
 		regs:   &registers{},
 		flags:  &flags{},
-		Ports:  Ports{},
 	}
-	cpu.Ports[0] = 0b00001110
-	cpu.Ports[1] = 0x8
-	return cpu
 }
 
 func (cpu *Cpu) ResetCpu() {
@@ -50,17 +73,53 @@ func (cpu *Cpu) ResetCpu() {
 	cpu.regs.l = 0
 	cpu.pc = 0
 	cpu.sp = 0
+	cpu.halted = false
 	cpu.memory = &Memory{}
 }
 
+// Reset acts as RESET pin: execution restarts at 0 with interrupts disabled,
+// registers and memory are kept like on real chip
+func (cpu *Cpu) Reset() {
+	cpu.pc = 0
+	cpu.halted = false
+	cpu.InterruptEnabled = false
+	cpu.eiDelay = false
+	cpu.irq = nil
+	cpu.busOp = nil
+	cpu.i8085.mask = 0x7
+	cpu.i8085.trapPending = false
+	cpu.i8085.rst75Pending = false
+}
+
 func (cpu *Cpu) GetCurrentOP() *decoder.Opcode {
 	return cpu.currentOp
 }
 
+// StepCycles returns clock periods (T states) taken by the last Step including
+// interrupt acknowledge and taken conditional branches
+func (cpu *Cpu) StepCycles() int {
+	return cpu.cycles
+}
+
+// branchTaken is called by conditional instruction whose condition is met, it takes longer
+func (cpu *Cpu) branchTaken() {
+	if taken := decoder.TakenCycles(cpu.Model, cpu.currentOp.Code); taken != 0 {
+		cpu.cycles += int(taken) - int(cpu.currentOp.Cycles)
+	}
+}
+
 func (cpu *Cpu) GetPC() uint16 {
 	return cpu.pc
 }
 
+func (cpu *Cpu) IsHalted() bool {
+	return cpu.halted
+}
+
+func (cpu *Cpu) GetSP() uint16 {
+	return cpu.sp
+}
+
 func (cpu *Cpu) GetMemAddr(addr uint16) uint8 {
 	return cpu.memory.read(addr)
 }
@@ -236,59 +295,166 @@ func (cpu *Cpu) executeInstruction() uint8 {
 	case decoder.IN:
 		return cpu.in()
 
+	// 8085
 	case decoder.RIM:
 		return cpu.rim()
-
-	//special
-
 	case decoder.SIM:
 		return cpu.sim()
+	case decoder.DSUB:
+		return cpu.dsub()
+	case decoder.ARHL:
+		return cpu.arhl()
+	case decoder.RDEL:
+		return cpu.rdel()
+	case decoder.LDHI:
+		return cpu.ldhi()
+	case decoder.LDSI:
+		return cpu.ldsi()
+	case decoder.RSTV:
+		return cpu.rstv()
+	case decoder.SHLX:
+		return cpu.shlx()
+	case decoder.LHLX:
+		return cpu.lhlx()
+	case decoder.JNK:
+		return cpu.jk()
+	case decoder.JK:
+		return cpu.jk()
 	default:
-		if cpu.currentOp.Instruction == 0 {
-			return 1
-		} else {
-			panic(fmt.Sprintf("Instruction %d is not found, pc: x%02x", cpu.currentOp.Instruction, cpu.pc))
-		}
+		cpu.fault = &UnknownOpcodeError{PC: cpu.pc, Opcode: cpu.currentOp.Code}
+		return 0
 	}
 }
 
+// GenerateInterrupt requests RST interruptNum, like device driving the bus with single RST
 func (cpu *Cpu) GenerateInterrupt(interruptNum int) {
-	//perform "PUSH PC"
-	// if cpu.sp <= 0x2000 {
-	// 	return fmt.Errorf("sp is too low")
-	// }
-	msb := uint8((cpu.pc & 0xFF00) >> 8)
-	lsb := uint8(cpu.pc)
-	cpu.memory.write(cpu.sp-1, msb)
-	cpu.memory.write(cpu.sp-2, lsb)
-	cpu.sp -= 2
+	cpu.RaiseInterrupt(0xc7 | uint8(interruptNum)<<3)
+}
+
+// RaiseInterrupt latches interrupt request. opcodeBytes is instruction put on data bus
+// during acknowledge, usually RST n or CALL addr from 8259 style controller.
+// Request stays pending until interrupts are enabled, new request replaces pending one
+func (cpu *Cpu) RaiseInterrupt(opcodeBytes ...byte) {
+	cpu.irq = append([]byte(nil), opcodeBytes...)
+}
+
+// ClearInterrupt drops pending request which was not acknowledged yet
+func (cpu *Cpu) ClearInterrupt() {
+	cpu.irq = nil
+}
+
+func (cpu *Cpu) InterruptPending() bool {
+	return cpu.irq != nil
+}
 
-	cpu.pc = uint16(8 * interruptNum)
+// acknowledgeInterrupt executes instruction from data bus in place of the next one.
+// It is executed as if it was located right before pc, so RST and CALL push address
+// of the interrupted instruction and other instructions leave pc unchanged
+func (cpu *Cpu) acknowledgeInterrupt() error {
+	bus := make([]byte, 3)
+	copy(bus, cpu.irq)
+	cpu.irq = nil
+	cpu.halted = false
+	cpu.InterruptEnabled = false
+	if cpu.InterruptAck != nil {
+		cpu.InterruptAck()
+	}
+
+	start := cpu.pc
+	cpu.currentOp = decoder.GetModelInstruction(cpu.Model, bus, 0)
+	cpu.busOp = bus
+	cpu.pc -= uint16(cpu.currentOp.Size)
+	cpu.fault = nil
+	// opcode fetch is replaced by acknowledge cycle, so it takes as long as the instruction
+	cpu.cycles += int(cpu.currentOp.Cycles)
+	n := cpu.executeInstruction()
+	cpu.busOp = nil
+	if cpu.fault != nil {
+		cpu.pc = start
+		return cpu.fault
+	}
+	cpu.pc += uint16(n)
+
+	if cpu.Profiler != nil && cpu.pc != start {
+		cpu.Profiler.interrupt(cpu.pc)
+	}
+	return nil
+}
+
+// operand8 returns byte following opcode of current instruction
+func (cpu *Cpu) operand8() uint8 {
+	if cpu.busOp != nil {
+		return cpu.busOp[1]
+	}
+	return cpu.readMem(cpu.pc + 1)
+}
+
+// operand16 returns address or data word following opcode of current instruction
+func (cpu *Cpu) operand16() uint16 {
+	if cpu.busOp != nil {
+		return misc.Make16bit(cpu.busOp[2], cpu.busOp[1])
+	}
+	return misc.Make16bit(cpu.readMem(cpu.pc+2), cpu.readMem(cpu.pc+1))
+}
 
-	cpu.di()
+func (cpu *Cpu) pushWord(val uint16) {
+	cpu.writeMem(cpu.sp-1, uint8(val>>8))
+	cpu.writeMem(cpu.sp-2, uint8(val))
+	cpu.sp -= 2
 }
 
-func (cpu *Cpu) Step() {
-	// if cpu.pc == 0x8 {
-	// 	fmt.Println("RST 1")
-	// } else if cpu.pc == 0x10 {
-	// 	fmt.Println("RST 2")
-	// } else if cpu.pc == 0x87 {
-	// 	fmt.Println("Leaving RST")
-	// }
-	// disassebmle(cpu)
-	// debugCpuState(cpu)
-	cpu.currentOp = getOpcode(*cpu.memory, cpu.pc)
+// Step executes single instruction. On error pc is left at the failed instruction
+func (cpu *Cpu) Step() error {
+	cpu.cycles = 0
+	cpu.applyPokes()
+	if cpu.Model == decoder.I8085 {
+		cpu.service8085Interrupts()
+	}
+	if cpu.irq != nil && cpu.InterruptEnabled && !cpu.eiDelay {
+		return cpu.acknowledgeInterrupt()
+	}
+	cpu.eiDelay = false
+	if cpu.halted {
+		// current op stays HLT so time keeps going by its cycles
+		cpu.cycles += int(cpu.currentOp.Cycles)
+		return nil
+	}
+	cpu.currentOp = cpu.decode(cpu.pc)
+	cpu.cycles += int(cpu.currentOp.Cycles)
+	if cpu.Profiler != nil {
+		cpu.Profiler.beforeStep(cpu)
+	}
+	cpu.fault = nil
 	n := cpu.executeInstruction()
+	if cpu.fault != nil {
+		return cpu.fault
+	}
 	cpu.pc += uint16(n)
+	if cpu.Profiler != nil {
+		cpu.Profiler.afterStep(cpu)
+	}
+	if cpu.halted {
+		return &HaltedError{PC: cpu.pc - 1, Opcode: cpu.currentOp.Code}
+	}
+	return nil
+}
+
+// Run executes instructions until any error, including HLT
+func (cpu *Cpu) Run() error {
+	for {
+		if err := cpu.Step(); err != nil {
+			return err
+		}
+	}
 }
 
 func (cpu *Cpu) GetAccumulator() uint8 {
 	return cpu.regs.a
 }
 
-func getOpcode(memory Memory, pc uint16) *decoder.Opcode {
-	return decoder.GetInstruction(memory[:], pc)
+// decode returns instruction at addr for selected cpu model
+func (cpu *Cpu) decode(addr uint16) *decoder.Opcode {
+	return decoder.GetModelInstruction(cpu.Model, cpu.memory[:], addr)
 }
 
 func (cpu *Cpu) nop() uint8 {
@@ -296,9 +462,8 @@ func (cpu *Cpu) nop() uint8 {
 }
 
 func (cpu *Cpu) lxi() uint8 {
-	msb := cpu.memory.read(cpu.pc + 2)
-	lsb := cpu.memory.read(cpu.pc + 1)
-	cpu.updatePairRegs(cpu.currentOp.HighNibble, msb, lsb)
+	val := cpu.operand16()
+	cpu.updatePairRegs(cpu.currentOp.HighNibble, uint8(val>>8), uint8(val))
 	return 3
 }
 
@@ -306,7 +471,7 @@ func (cpu *Cpu) stax() uint8 {
 	reg := cpu.currentOp.HighNibble
 	addr := cpu.getPair(reg)
 	accumVal := cpu.regs.a
-	cpu.memory.write(addr, accumVal)
+	cpu.writeMem(addr, accumVal)
 	return 1
 }
 
@@ -316,6 +481,7 @@ func (cpu *Cpu) inx() uint8 {
 	b1 := uint8(bits >> 8)
 	b2 := uint8(bits & 0xff)
 	cpu.updatePairRegs(reg, b1, b2)
+	cpu.flags.k = boolToBit(bits == 0x0000)
 	return 1
 }
 
@@ -324,8 +490,9 @@ func (cpu *Cpu) inr() uint8 {
 	regVal := cpu.GetReg(reg)
 	res := regVal + 1
 	cpu.updateReg(reg, res)
-	cpu.setAux((regVal&0x0F == 0x0F))
-	cpu.updateFlags(res, 0)
+	cpu.updateFlags(res)
+	cpu.setAux(res&0x0F == 0)
+	cpu.setOverflow(regVal, 1, res, false)
 	return 1
 }
 
@@ -334,13 +501,15 @@ func (cpu *Cpu) dcr() uint8 {
 	regVal := cpu.GetReg(reg)
 	res := regVal - 1
 	cpu.updateReg(reg, res)
-	cpu.setAux((regVal&0x0F == 0x00))
-	cpu.updateFlags(res, 0)
+	cpu.updateFlags(res)
+	// DCR adds 0xFF, so there is carry out of bit 3 unless low nibble was 0
+	cpu.setAux(res&0x0F != 0x0F)
+	cpu.setOverflow(regVal, 1, res, true)
 	return 1
 }
 
 func (cpu *Cpu) mvi() uint8 {
-	immediate := cpu.memory[cpu.pc+1]
+	immediate := cpu.operand8()
 	cpu.updateReg((cpu.currentOp.Code >> 3), immediate)
 	return 2
 }
@@ -367,7 +536,7 @@ func (cpu *Cpu) dad() uint8 {
 func (cpu *Cpu) ldax() uint8 {
 	reg := cpu.currentOp.HighNibble
 	addr := cpu.getPair(reg)
-	memVal := cpu.memory.read(addr)
+	memVal := cpu.readMem(addr)
 	cpu.updateReg(A_REG, memVal)
 	return 1
 }
@@ -376,6 +545,7 @@ func (cpu *Cpu) dcx() uint8 {
 	reg := cpu.currentOp.HighNibble
 	pairVal := cpu.getPair(reg) - 1
 	cpu.updatePairRegs(reg, uint8(pairVal>>8), uint8(pairVal&0xff))
+	cpu.flags.k = boolToBit(pairVal == 0xFFFF)
 	return 1
 }
 
@@ -446,22 +616,17 @@ func (cpu *Cpu) rar() uint8 {
 	return 1
 }
 
-// some I/O thing
-func (cpu *Cpu) rim() uint8 {
-	return 1
-}
-
 func (cpu *Cpu) shld() uint8 {
-	addr := misc.Make16bit(cpu.memory.read(cpu.pc+2), cpu.memory.read(cpu.pc+1))
-	cpu.memory.write(addr, cpu.regs.l)
-	cpu.memory.write(addr+1, cpu.regs.h)
+	addr := cpu.operand16()
+	cpu.writeMem(addr, cpu.regs.l)
+	cpu.writeMem(addr+1, cpu.regs.h)
 	return 3
 }
 
 func (cpu *Cpu) lhld() uint8 {
-	addr := misc.Make16bit(cpu.memory.read(cpu.pc+2), cpu.memory.read(cpu.pc+1))
-	l := cpu.memory.read(addr)
-	h := cpu.memory.read(addr + 1)
+	addr := cpu.operand16()
+	l := cpu.readMem(addr)
+	h := cpu.readMem(addr + 1)
 	cpu.regs.l = l
 	cpu.regs.h = h
 	return 3
@@ -472,35 +637,30 @@ func (cpu *Cpu) cma() uint8 {
 	return 1
 }
 
-// some useless command
+// decimal adjust accumulator, CY is only ever set here, never cleared
 func (cpu *Cpu) daa() uint8 {
 	accum := cpu.regs.a
+	lsb := accum & 0x0F
+	msb := accum >> 4
+	carry := cpu.flags.cy
 
-	if accum&0xf > 9 || cpu.flags.ac == 1 {
-		accum += 0x06
-		if (accum & 0x0F) < 0x09 {
-			cpu.flags.ac = 1
-		}
+	var correction uint8
+	if cpu.flags.ac == 1 || lsb > 9 {
+		correction |= 0x06
 	}
-
-	if ((accum & 0xF0) > 0x90) || cpu.flags.cy == 1 {
-		accum, cpu.flags.cy = misc.OverflowingAdd(accum, 0x60, 0)
+	if cpu.flags.cy == 1 || msb > 9 || (msb >= 9 && lsb > 9) {
+		correction |= 0x60
+		carry = 1
 	}
 
-	cpu.regs.a = accum
-	// cpu.updateFlags(cpu.regs.a)
-
-	return 1
-}
-
-// special
-func (cpu *Cpu) sim() uint8 {
+	cpu.regs.a = cpu.addFlags(accum, correction, 0)
+	cpu.flags.cy = carry
 	return 1
 }
 
 func (cpu *Cpu) sta() uint8 {
-	addr := misc.Make16bit(cpu.memory.read(cpu.pc+2), cpu.memory.read(cpu.pc+1))
-	cpu.memory.write(addr, cpu.regs.a)
+	addr := cpu.operand16()
+	cpu.writeMem(addr, cpu.regs.a)
 	return 3
 }
 
@@ -510,8 +670,8 @@ func (cpu *Cpu) stc() uint8 {
 }
 
 func (cpu *Cpu) lda() uint8 {
-	addr := misc.Make16bit(cpu.memory.read(cpu.pc+2), cpu.memory.read(cpu.pc+1))
-	cpu.regs.a = cpu.memory.read(addr)
+	addr := cpu.operand16()
+	cpu.regs.a = cpu.readMem(addr)
 	return 3
 }
 
@@ -528,24 +688,22 @@ func (cpu *Cpu) mov() uint8 {
 	return 1
 }
 
-// halt
+// halt, pc points to the next instruction which is executed after interrupt returns
 func (cpu *Cpu) hlt() uint8 {
-	os.Exit(0)
-	return 0
+	cpu.halted = true
+	return 1
 }
 
 func (cpu *Cpu) cmp() uint8 {
 	var operand uint8
 
 	if cpu.currentOp.Instruction == decoder.CPI {
-		operand = cpu.memory.read(cpu.pc + 1)
+		operand = cpu.operand8()
 	} else {
 		operand = cpu.GetReg(cpu.currentOp.LowNibble)
 	}
 
-	res, carry := misc.OverflowingSub(cpu.regs.a, operand, 0)
-	cpu.updateFlags(res, carry)
-	cpu.setAux((cpu.regs.a & 0x0F) < (operand & 0x0F))
+	cpu.subFlags(cpu.regs.a, operand, 0)
 
 	if cpu.currentOp.Instruction == decoder.CPI {
 		return 2
@@ -559,15 +717,14 @@ func (cpu *Cpu) xra() uint8 {
 	var operand uint8
 
 	if cpu.currentOp.Instruction == decoder.XRI {
-		operand = cpu.memory.read(cpu.pc + 1)
+		operand = cpu.operand8()
 	} else {
 		operand = cpu.GetReg(cpu.currentOp.LowNibble)
 	}
 
 	res = cpu.regs.a ^ operand
 	cpu.regs.a = res
-
-	cpu.updateFlags(res, 0)
+	cpu.logicFlags(res, false)
 
 	if cpu.currentOp.Instruction == decoder.XRI {
 		return 2
@@ -582,14 +739,14 @@ func (cpu *Cpu) ana() uint8 {
 	prevAccum := cpu.regs.a
 
 	if cpu.currentOp.Instruction == decoder.ANI {
-		operand = cpu.memory.read(cpu.pc + 1)
+		operand = cpu.operand8()
 	} else {
 		operand = cpu.GetReg(cpu.currentOp.LowNibble)
 	}
 
 	res = prevAccum & operand
 	cpu.regs.a = res
-	cpu.updateFlags(res, 0)
+	cpu.logicFlags(res, cpu.andAux(prevAccum, operand))
 
 	if cpu.currentOp.Instruction == decoder.ANI {
 		return 2
@@ -599,31 +756,19 @@ func (cpu *Cpu) ana() uint8 {
 }
 
 func (cpu *Cpu) add() uint8 {
-	var res uint8
 	var operand uint8
 	var carry uint8
-	prevAccum := cpu.regs.a
 
 	if cpu.currentOp.Instruction == decoder.ADI || cpu.currentOp.Instruction == decoder.ACI {
-		operand = cpu.memory.read(cpu.pc + 1)
+		operand = cpu.operand8()
 	} else {
 		operand = cpu.GetReg(cpu.currentOp.LowNibble)
 	}
 
-	switch cpu.currentOp.Instruction {
-	case decoder.ADD:
-		res, carry = misc.OverflowingAdd(prevAccum, operand, 0)
-	case decoder.ADC:
-		res, carry = misc.OverflowingAdd(prevAccum, operand, cpu.flags.cy)
-	case decoder.ADI:
-		res, carry = misc.OverflowingAdd(prevAccum, operand, 0)
-	case decoder.ACI:
-		res, carry = misc.OverflowingAdd(prevAccum, operand, cpu.flags.cy)
+	if cpu.currentOp.Instruction == decoder.ADC || cpu.currentOp.Instruction == decoder.ACI {
+		carry = cpu.flags.cy
 	}
-
-	cpu.regs.a = res
-	cpu.updateFlags(res, carry)
-	cpu.setAux((prevAccum&0x0F)+(operand&0x0F) > 0x0F)
+	cpu.regs.a = cpu.addFlags(cpu.regs.a, operand, carry)
 
 	if cpu.currentOp.Instruction == decoder.ADI || cpu.currentOp.Instruction == decoder.ACI {
 		return 2
@@ -633,31 +778,19 @@ func (cpu *Cpu) add() uint8 {
 }
 
 func (cpu *Cpu) sub() uint8 {
-	var res uint8
-	var carry uint8
+	var borrow uint8
 	var operand uint8
-	prevAccum := cpu.regs.a
 
 	if cpu.currentOp.Instruction == decoder.SUI || cpu.currentOp.Instruction == decoder.SBI {
-		operand = cpu.memory.read(cpu.pc + 1)
+		operand = cpu.operand8()
 	} else {
 		operand = cpu.GetReg(cpu.currentOp.LowNibble)
 	}
 
-	switch cpu.currentOp.Instruction {
-	case decoder.SUB:
-		res, carry = misc.OverflowingSub(prevAccum, operand, 0)
-	case decoder.SBB:
-		res, carry = misc.OverflowingSub(prevAccum, operand, cpu.flags.cy)
-	case decoder.SUI:
-		res, carry = misc.OverflowingSub(prevAccum, operand, 0)
-	case decoder.SBI:
-		res, carry = misc.OverflowingSub(prevAccum, operand, cpu.flags.cy)
+	if cpu.currentOp.Instruction == decoder.SBB || cpu.currentOp.Instruction == decoder.SBI {
+		borrow = cpu.flags.cy
 	}
-
-	cpu.regs.a = res
-	cpu.updateFlags(res, carry)
-	cpu.setAux((prevAccum & 0x0F) < (operand & 0x0F))
+	cpu.regs.a = cpu.subFlags(cpu.regs.a, operand, borrow)
 	if cpu.currentOp.Instruction == decoder.SUI || cpu.currentOp.Instruction == decoder.SBI {
 		return 2
 	}
@@ -670,7 +803,7 @@ func (cpu *Cpu) ora() uint8 {
 	var operand uint8
 
 	if cpu.currentOp.Instruction == decoder.ORI {
-		operand = cpu.memory.read(cpu.pc + 1)
+		operand = cpu.operand8()
 	} else {
 		operand = cpu.GetReg(cpu.currentOp.LowNibble)
 	}
@@ -678,7 +811,7 @@ func (cpu *Cpu) ora() uint8 {
 	res = cpu.regs.a | operand
 
 	cpu.regs.a = res
-	cpu.updateFlags(res, 0)
+	cpu.logicFlags(res, false)
 
 	if cpu.currentOp.Instruction == decoder.ORI {
 		return 2
@@ -688,47 +821,48 @@ func (cpu *Cpu) ora() uint8 {
 }
 
 func (cpu *Cpu) call() uint8 {
-	if misc.Make16bit(cpu.memory.read(cpu.pc+2), cpu.memory.read(cpu.pc+1)) == decoder.BDOS {
-		if cpu.regs.c == 0x9 {
-			addr := cpu.getPair(DE_REG)
-			var msg []byte
-			for {
-				char := cpu.memory.read(addr)
-				msg = append(msg, char)
-				addr++
-				if string(char) == "$" {
-					break
-				}
-			}
-			fmt.Printf("OUTPUT MESSAGE: %s\n", msg)
-			os.Exit(1)
-		}
-	} else {
-		if cpu.currentOp.Condition == 0 || cpu.checkConditionFlag() {
-			lsb := uint8(cpu.memory[cpu.pc+1])
-			msb := uint8(cpu.memory[cpu.pc+2])
-			addr := misc.Make16bit(msb, lsb)
-
-			nextAddr := cpu.pc + 3
-			lsbNextAddr := uint8(nextAddr & 0x00FF)
-			msbNextAddr := uint8((nextAddr & 0xFF00) >> 8)
-
-			cpu.memory.write(cpu.sp-1, msbNextAddr)
-			cpu.memory.write(cpu.sp-2, lsbNextAddr)
+	// CALL from data bus during acknowledge is interrupt, not program calling CP/M
+	if cpu.busOp == nil && cpu.operand16() == decoder.BDOS {
+		return cpu.bdos()
+	}
 
-			cpu.sp = cpu.sp - 2
-			cpu.pc = addr
+	if cpu.currentOp.Condition == 0 || cpu.checkConditionFlag() {
+		cpu.branchTaken()
+		cpu.pushWord(cpu.pc + 3)
+		cpu.pc = cpu.operand16()
+		return 0
+	}
+	return 3
+}
 
-			return 0
+// bdos emulates CP/M console functions used by test programs
+func (cpu *Cpu) bdos() uint8 {
+	switch cpu.regs.c {
+	case 0x0:
+		cpu.fault = &BDOSExitError{PC: cpu.pc, Opcode: cpu.currentOp.Code}
+		return 0
+	case 0x2:
+		fmt.Printf("%c", cpu.regs.e)
+	case 0x9:
+		addr := cpu.getPair(DE_REG)
+		var msg []byte
+		for {
+			char := cpu.readMem(addr)
+			if string(char) == "$" {
+				break
+			}
+			msg = append(msg, char)
+			addr++
 		}
-		return 3
+		fmt.Printf("OUTPUT MESSAGE: %s\n", msg)
 	}
 	return 3
 }
 
 func (cpu *Cpu) jmp() uint8 {
 	if cpu.currentOp.Condition == 0 || cpu.checkConditionFlag() {
-		cpu.pc = misc.Make16bit(cpu.memory.read(cpu.pc+2), cpu.memory.read(cpu.pc+1))
+		cpu.branchTaken()
+		cpu.pc = cpu.operand16()
 
 		return 0
 	}
@@ -739,10 +873,11 @@ func (cpu *Cpu) jmp() uint8 {
 func (cpu *Cpu) ret() uint8 {
 
 	if cpu.currentOp.Condition == 0 || cpu.checkConditionFlag() {
+		cpu.branchTaken()
 		var addr uint16
 
-		lsb := cpu.memory.read(cpu.sp)
-		msb := cpu.memory.read(cpu.sp + 1)
+		lsb := cpu.readMem(cpu.sp)
+		msb := cpu.readMem(cpu.sp + 1)
 		addr = uint16(uint16(lsb) | uint16(msb)<<8)
 		cpu.sp += 2
 		cpu.pc = addr
@@ -761,11 +896,11 @@ func (cpu *Cpu) push() uint8 {
 	msb := uint8((pairVal & 0xff00) >> 8)
 
 	if reg&0b11 == SP_REG {
-		cpu.memory.write(sp-1, cpu.regs.a)
-		cpu.memory.write(sp-2, cpu.flags.cy|cpu.flags.p<<2|cpu.flags.ac<<4|cpu.flags.z<<6|cpu.flags.s<<7)
+		cpu.writeMem(sp-1, cpu.regs.a)
+		cpu.writeMem(sp-2, cpu.psw())
 	} else {
-		cpu.memory.write(sp-1, msb)
-		cpu.memory.write(sp-2, lsb)
+		cpu.writeMem(sp-1, msb)
+		cpu.writeMem(sp-2, lsb)
 	}
 	cpu.sp -= 2
 
@@ -775,17 +910,12 @@ func (cpu *Cpu) push() uint8 {
 func (cpu *Cpu) pop() uint8 {
 	sp := cpu.sp
 	reg := cpu.currentOp.HighNibble
-	msb := cpu.memory.read(sp + 1)
-	lsb := cpu.memory.read(sp)
+	msb := cpu.readMem(sp + 1)
+	lsb := cpu.readMem(sp)
 
 	if reg&0b11 == SP_REG {
-		psw := cpu.memory.read(sp)
-		cpu.flags.cy = psw & 0x1
-		cpu.flags.p = (psw >> 2) & 0x1
-		cpu.flags.ac = (psw >> 4) & 0x1
-		cpu.flags.z = (psw >> 6) & 0x1
-		cpu.flags.s = (psw >> 7) & 0x1
-		cpu.regs.a = cpu.memory.read(sp + 1)
+		cpu.setPSW(cpu.readMem(sp))
+		cpu.regs.a = cpu.readMem(sp + 1)
 	} else {
 		cpu.updatePairRegs(reg, msb, lsb)
 	}
@@ -804,10 +934,10 @@ func (cpu *Cpu) xthl() uint8 {
 	hVal := cpu.regs.h
 	sp1Addr := cpu.sp
 	sp2Addr := cpu.sp + 1
-	cpu.regs.l = cpu.memory.read(cpu.sp)
-	cpu.regs.h = cpu.memory.read(cpu.sp + 1)
-	cpu.memory.write(sp1Addr, lVal)
-	cpu.memory.write(sp2Addr, hVal)
+	cpu.regs.l = cpu.readMem(cpu.sp)
+	cpu.regs.h = cpu.readMem(cpu.sp + 1)
+	cpu.writeMem(sp1Addr, lVal)
+	cpu.writeMem(sp2Addr, hVal)
 	return 1
 }
 
@@ -821,28 +951,35 @@ func (cpu *Cpu) xchg() uint8 {
 }
 
 func (cpu *Cpu) rst() uint8 {
-	resetAddr := cpu.currentOp.Code & 0b00111000
-	cpu.memory.write(cpu.sp-1, uint8(cpu.pc&0x0f))
-	cpu.memory.write(cpu.sp-2, uint8((cpu.pc>>8)&0x0f))
-	cpu.sp -= 2
-	cpu.pc = uint16(resetAddr - 1)
+	cpu.pushWord(cpu.pc + 1)
+	cpu.pc = uint16(cpu.currentOp.Code & 0b00111000)
 
 	return 0
 }
 
 func (cpu *Cpu) in() uint8 {
-	val := cpu.IO_handler.InPort(cpu)
-	cpu.updateReg(A_REG, val)
+	port := cpu.operand8()
+	if cpu.IO == nil {
+		cpu.fault = &BusError{PC: cpu.pc, Opcode: cpu.currentOp.Code, Port: port}
+		return 0
+	}
+	cpu.updateReg(A_REG, cpu.IO.In(port))
 	return 2
 }
 
 func (cpu *Cpu) out() uint8 {
-	cpu.IO_handler.OutPort(cpu)
+	port := cpu.operand8()
+	if cpu.IO == nil {
+		cpu.fault = &BusError{PC: cpu.pc, Opcode: cpu.currentOp.Code, Port: port}
+		return 0
+	}
+	cpu.IO.Out(port, cpu.regs.a)
 	return 2
 }
 
 func (cpu *Cpu) ei() uint8 {
 	cpu.InterruptEnabled = true
+	cpu.eiDelay = true
 	return 1
 }
 
@@ -0,0 +1,674 @@
+package machine
+
+import (
+	"bufio"
+	"cpu-emulator/decoder"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultDAPAddr = "127.0.0.1:4711"
+
+const (
+	dapThreadID     = 1
+	dapRegistersRef = 1
+	dapFlagsRef     = 2
+)
+
+// Listing maps lines of an assembler listing file to addresses.
+// Every line which starts with 4 hex digits address followed by code bytes is mapped
+type Listing struct {
+	Path        string
+	lineToAddr  map[int]uint16
+	addrToLine  map[uint16]int
+	sortedLines []int
+}
+
+func LoadListing(path string) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+
+	listing := &Listing{
+		Path:       abs,
+		lineToAddr: map[int]uint16{},
+		addrToLine: map[uint16]int{},
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		addr, ok := parseListingLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		listing.lineToAddr[line] = addr
+		listing.sortedLines = append(listing.sortedLines, line)
+		if _, exists := listing.addrToLine[addr]; !exists {
+			listing.addrToLine[addr] = line
+		}
+	}
+
+	return listing, scanner.Err()
+}
+
+// parseListingLine accepts lines like "0100 C3 AB 01    JMP START" or "0100: C3AB01 ..."
+func parseListingLine(text string) (uint16, bool) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return 0, false
+	}
+
+	addrField := strings.TrimSuffix(fields[0], ":")
+	if len(addrField) != 4 {
+		return 0, false
+	}
+	addr, err := strconv.ParseUint(addrField, 16, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	if len(fields[1])%2 != 0 {
+		return 0, false
+	}
+	if _, err := strconv.ParseUint(fields[1], 16, 64); err != nil {
+		return 0, false
+	}
+
+	return uint16(addr), true
+}
+
+// addrForLine returns address of the first code line at or after requested line
+func (l *Listing) addrForLine(line int) (uint16, int, bool) {
+	for _, codeLine := range l.sortedLines {
+		if codeLine >= line {
+			return l.lineToAddr[codeLine], codeLine, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (l *Listing) lineForAddr(addr uint16) int {
+	return l.addrToLine[addr]
+}
+
+type dapMessage struct {
+	Seq     int             `json:"seq"`
+	Type    string          `json:"type"`
+	Command string          `json:"command,omitempty"`
+	Args    json.RawMessage `json:"arguments,omitempty"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Command    string `json:"command"`
+	Success    bool   `json:"success"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// DAPServer implements Debug Adapter Protocol on top of Cpu.Step
+// so 8080 programs can be debugged from DAP-aware editors
+type DAPServer struct {
+	cpu     *Cpu
+	listing *Listing
+	// Step executes one instruction, it is cpu.Step by default. Boards replace it
+	// so their devices and interrupts advance together with cpu
+	Step func() error
+
+	mu          sync.Mutex
+	breakpoints map[uint16]bool
+	running     bool
+	stop        chan struct{}
+
+	writeLock sync.Mutex
+	out       io.Writer
+	seq       int
+}
+
+func NewDAPServer(cpu *Cpu, listing *Listing) *DAPServer {
+	return &DAPServer{
+		cpu:         cpu,
+		listing:     listing,
+		Step:        cpu.Step,
+		breakpoints: map[uint16]bool{},
+	}
+}
+
+// ListenAndServe accepts editor connections one at a time
+func (dap *DAPServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("DAP server is listening on %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		dap.Serve(conn, conn)
+		conn.Close()
+	}
+}
+
+// Serve processes Content-Length framed messages until disconnect
+func (dap *DAPServer) Serve(in io.Reader, out io.Writer) {
+	dap.out = out
+	reader := textproto.NewReader(bufio.NewReader(in))
+
+	for {
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader.R, body); err != nil {
+			return
+		}
+
+		var msg dapMessage
+		if err := json.Unmarshal(body, &msg); err != nil || msg.Type != "request" {
+			continue
+		}
+		if !dap.handle(msg) {
+			return
+		}
+	}
+}
+
+func (dap *DAPServer) send(v any) {
+	dap.writeLock.Lock()
+	defer dap.writeLock.Unlock()
+
+	dap.seq++
+	switch m := v.(type) {
+	case *dapResponse:
+		m.Seq = dap.seq
+	case *dapEvent:
+		m.Seq = dap.seq
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(dap.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (dap *DAPServer) event(name string, body any) {
+	dap.send(&dapEvent{Type: "event", Event: name, Body: body})
+}
+
+func (dap *DAPServer) stopped(reason string) {
+	dap.event("stopped", map[string]any{
+		"reason":            reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	})
+}
+
+func (dap *DAPServer) stoppedOnError(err error) {
+	dap.event("stopped", map[string]any{
+		"reason":            "exception",
+		"text":              err.Error(),
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	})
+}
+
+func (dap *DAPServer) handle(msg dapMessage) bool {
+	resp := &dapResponse{Type: "response", RequestSeq: msg.Seq, Command: msg.Command, Success: true}
+	var err error
+	next := true
+
+	switch msg.Command {
+	case "initialize":
+		resp.Body = map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+			"supportsDisassembleRequest":       true,
+			"supportsSteppingGranularity":      true,
+		}
+	case "launch", "attach":
+	case "configurationDone":
+		defer dap.stopped("entry")
+	case "threads":
+		resp.Body = map[string]any{
+			"threads": []map[string]any{{"id": dapThreadID, "name": "i8080"}},
+		}
+	case "setBreakpoints":
+		resp.Body, err = dap.setBreakpoints(msg.Args)
+	case "stackTrace":
+		resp.Body = dap.stackTrace()
+	case "scopes":
+		resp.Body = map[string]any{
+			"scopes": []map[string]any{
+				{"name": "Registers", "variablesReference": dapRegistersRef, "expensive": false},
+				{"name": "Flags", "variablesReference": dapFlagsRef, "expensive": false},
+			},
+		}
+	case "variables":
+		resp.Body, err = dap.variables(msg.Args)
+	case "readMemory":
+		resp.Body, err = dap.readMemory(msg.Args)
+	case "disassemble":
+		resp.Body, err = dap.disassemble(msg.Args)
+	case "continue":
+		resp.Body = map[string]any{"allThreadsContinued": true}
+		dap.cont()
+	case "pause":
+		dap.pause()
+	case "next":
+		defer dap.stepOver()
+	case "stepIn":
+		defer dap.stepIn()
+	case "stepOut":
+		defer dap.stepOut()
+	case "disconnect":
+		dap.pause()
+		next = false
+	default:
+		err = fmt.Errorf("unsupported request %q", msg.Command)
+	}
+
+	if err != nil {
+		resp.Success = false
+		resp.Message = err.Error()
+	}
+	dap.send(resp)
+
+	if msg.Command == "initialize" {
+		dap.event("initialized", nil)
+	}
+	return next
+}
+
+func (dap *DAPServer) setBreakpoints(args json.RawMessage) (any, error) {
+	var req struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	dap.breakpoints = map[uint16]bool{}
+	result := []map[string]any{}
+	for _, bp := range req.Breakpoints {
+		if dap.listing == nil {
+			result = append(result, map[string]any{"verified": false, "message": "no listing file"})
+			continue
+		}
+		addr, line, ok := dap.listing.addrForLine(bp.Line)
+		if !ok {
+			result = append(result, map[string]any{"verified": false, "line": bp.Line})
+			continue
+		}
+		dap.breakpoints[addr] = true
+		result = append(result, map[string]any{
+			"verified":             true,
+			"line":                 line,
+			"instructionReference": fmt.Sprintf("0x%04x", addr),
+			"source":               dap.source(),
+		})
+	}
+
+	return map[string]any{"breakpoints": result}, nil
+}
+
+func (dap *DAPServer) source() *dapSource {
+	if dap.listing == nil {
+		return nil
+	}
+	return &dapSource{Name: filepath.Base(dap.listing.Path), Path: dap.listing.Path}
+}
+
+func (dap *DAPServer) stackTrace() any {
+	dap.mu.Lock()
+	pc := dap.cpu.pc
+	dap.mu.Unlock()
+
+	frame := map[string]any{
+		"id":                          0,
+		"name":                        fmt.Sprintf("0x%04x", pc),
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("0x%04x", pc),
+	}
+	if dap.listing != nil {
+		if line := dap.listing.lineForAddr(pc); line != 0 {
+			frame["line"] = line
+			frame["column"] = 1
+			frame["source"] = dap.source()
+		}
+	}
+
+	return map[string]any{"stackFrames": []any{frame}, "totalFrames": 1}
+}
+
+func (dap *DAPServer) variables(args json.RawMessage) (any, error) {
+	var req struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	cpu := dap.cpu
+	variable := func(name, value string) map[string]any {
+		return map[string]any{"name": name, "value": value, "variablesReference": 0}
+	}
+	hex8 := func(name string, val uint8) map[string]any {
+		return variable(name, fmt.Sprintf("0x%02x", val))
+	}
+	hex16 := func(name string, val uint16) map[string]any {
+		v := variable(name, fmt.Sprintf("0x%04x", val))
+		v["memoryReference"] = fmt.Sprintf("0x%04x", val)
+		return v
+	}
+
+	var vars []map[string]any
+	switch req.VariablesReference {
+	case dapRegistersRef:
+		vars = []map[string]any{
+			hex8("A", cpu.regs.a), hex8("B", cpu.regs.b), hex8("C", cpu.regs.c),
+			hex8("D", cpu.regs.d), hex8("E", cpu.regs.e), hex8("H", cpu.regs.h), hex8("L", cpu.regs.l),
+			hex16("BC", cpu.getPair(BC_REG)), hex16("DE", cpu.getPair(DE_REG)), hex16("HL", cpu.getPair(HL_REG)),
+			hex16("SP", cpu.sp), hex16("PC", cpu.pc),
+		}
+	case dapFlagsRef:
+		vars = []map[string]any{
+			variable("S", strconv.Itoa(int(cpu.flags.s))),
+			variable("Z", strconv.Itoa(int(cpu.flags.z))),
+			variable("AC", strconv.Itoa(int(cpu.flags.ac))),
+			variable("P", strconv.Itoa(int(cpu.flags.p))),
+			variable("CY", strconv.Itoa(int(cpu.flags.cy))),
+			variable("INTE", strconv.FormatBool(cpu.InterruptEnabled)),
+			variable("HALTED", strconv.FormatBool(cpu.halted)),
+		}
+	default:
+		return nil, fmt.Errorf("unknown variables reference %d", req.VariablesReference)
+	}
+
+	return map[string]any{"variables": vars}, nil
+}
+
+func parseMemoryReference(ref string) (uint16, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(ref, "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory reference %q", ref)
+	}
+	return uint16(n), nil
+}
+
+func (dap *DAPServer) readMemory(args json.RawMessage) (any, error) {
+	var req struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+	base, err := parseMemoryReference(req.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+	if req.Count < 0 {
+		return nil, fmt.Errorf("count must not be negative")
+	}
+
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	start := uint16(int(base) + req.Offset)
+	// the whole address space at most, reading wraps around like cpu does
+	data := make([]byte, min(req.Count, 0x10000))
+	for i := range data {
+		data[i] = dap.cpu.memory.read(start + uint16(i))
+	}
+
+	return map[string]any{
+		"address": fmt.Sprintf("0x%04x", start),
+		"data":    base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+func (dap *DAPServer) disassemble(args json.RawMessage) (any, error) {
+	var req struct {
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+	base, err := parseMemoryReference(req.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	// 8080 code can't be decoded backwards, so negative offsets are approximated by bytes
+	addr := uint16(int(base) + req.Offset)
+	if req.InstructionOffset < 0 {
+		addr -= uint16(-req.InstructionOffset)
+	} else {
+		for i := 0; i < req.InstructionOffset; i++ {
+			addr += uint16(dap.cpu.decode(addr).Size)
+		}
+	}
+
+	instructions := []map[string]any{}
+	for i := 0; i < req.InstructionCount; i++ {
+		op := dap.cpu.decode(addr)
+		var raw []string
+		for j := uint16(0); j < uint16(op.Size); j++ {
+			raw = append(raw, fmt.Sprintf("%02x", dap.cpu.memory.read(addr+j)))
+		}
+
+		ins := map[string]any{
+			"address":          fmt.Sprintf("0x%04x", addr),
+			"instructionBytes": strings.Join(raw, " "),
+			"instruction":      op.Name,
+		}
+		if dap.listing != nil {
+			if line := dap.listing.lineForAddr(addr); line != 0 {
+				ins["line"] = line
+				ins["location"] = dap.source()
+			}
+		}
+		instructions = append(instructions, ins)
+		addr += uint16(op.Size)
+	}
+
+	return map[string]any{"instructions": instructions}, nil
+}
+
+func (dap *DAPServer) cont() {
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	dap.start(func() (string, bool) { return "", false })
+}
+
+// start runs cpu in background until breakpoint, pause or until reports stop reason.
+// Must be called with mu held
+func (dap *DAPServer) start(until func() (string, bool)) {
+	if dap.running {
+		return
+	}
+	dap.running = true
+	dap.stop = make(chan struct{})
+	go dap.run(dap.stop, until)
+}
+
+func (dap *DAPServer) run(stop chan struct{}, until func() (string, bool)) {
+	// current instruction is executed even if there is breakpoint on it
+	first := true
+	dap.mu.Lock()
+	wasHalted := dap.cpu.halted
+	dap.mu.Unlock()
+	for {
+		select {
+		case <-stop:
+			dap.stopped("pause")
+			return
+		default:
+		}
+
+		dap.mu.Lock()
+		if !first && !dap.cpu.halted && dap.breakpoints[dap.cpu.pc] {
+			dap.running = false
+			dap.mu.Unlock()
+			dap.stopped("breakpoint")
+			return
+		}
+		err := dap.Step()
+		first = false
+
+		if err != nil && !errors.As(err, new(*HaltedError)) {
+			dap.running = false
+			dap.mu.Unlock()
+			dap.stoppedOnError(err)
+			return
+		}
+		// halted cpu keeps running until interrupt wakes it, client is only told about it
+		halted, pc := dap.cpu.halted, dap.cpu.pc
+		if halted && !wasHalted {
+			dap.event("output", map[string]any{
+				"category": "console",
+				"output":   fmt.Sprintf("halted at 0x%04x\n", pc),
+			})
+		}
+		wasHalted = halted
+		if reason, done := until(); done {
+			dap.running = false
+			dap.mu.Unlock()
+			dap.stopped(reason)
+			return
+		}
+		dap.mu.Unlock()
+	}
+}
+
+func (dap *DAPServer) pause() {
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	if dap.running {
+		dap.running = false
+		close(dap.stop)
+	}
+}
+
+func (dap *DAPServer) stepIn() {
+	dap.mu.Lock()
+	if dap.running {
+		dap.mu.Unlock()
+		return
+	}
+	err := dap.Step()
+	dap.mu.Unlock()
+	if err != nil && !errors.As(err, new(*HaltedError)) {
+		dap.stoppedOnError(err)
+		return
+	}
+	dap.stopped("step")
+}
+
+// stepOver runs called subroutine to completion
+func (dap *DAPServer) stepOver() {
+	dap.mu.Lock()
+	op := dap.cpu.decode(dap.cpu.pc)
+	if !isCall(op) {
+		dap.mu.Unlock()
+		dap.stepIn()
+		return
+	}
+	defer dap.mu.Unlock()
+
+	returnAddr := dap.cpu.pc + uint16(op.Size)
+	sp := dap.cpu.sp
+	dap.start(func() (string, bool) {
+		return "step", dap.cpu.pc == returnAddr && dap.cpu.sp >= sp
+	})
+}
+
+// stepOut runs until current subroutine returns to its caller
+func (dap *DAPServer) stepOut() {
+	dap.mu.Lock()
+	defer dap.mu.Unlock()
+
+	sp := dap.cpu.sp
+	dap.start(func() (string, bool) {
+		return "step", isRet(dap.cpu.GetCurrentOP()) && dap.cpu.sp > sp
+	})
+}
+
+func isCall(op *decoder.Opcode) bool {
+	switch op.Instruction {
+	case decoder.CALL, decoder.CC, decoder.CZ, decoder.CNZ, decoder.CM,
+		decoder.CPE, decoder.CPO, decoder.CNC, decoder.CP, decoder.RST:
+		return true
+	}
+	return false
+}
+
+func isRet(op *decoder.Opcode) bool {
+	switch op.Instruction {
+	case decoder.RET, decoder.RC, decoder.RZ, decoder.RNZ, decoder.RM,
+		decoder.RP, decoder.RPE, decoder.RPO, decoder.RNC:
+		return true
+	}
+	return false
+}
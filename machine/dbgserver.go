@@ -0,0 +1,376 @@
+package machine
+
+import (
+	"bufio"
+	"cpu-emulator/decoder"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+const DefaultDebugServerAddr = "127.0.0.1:8080"
+
+// events pushed to every connected client
+const (
+	EventBreakpoint = "breakpoint"
+	EventStopped    = "stopped"
+	EventHalted     = "halted"
+	EventError      = "error"
+)
+
+// DebugRequest is a single JSON command, one per line
+type DebugRequest struct {
+	ID     int      `json:"id"`
+	Cmd    string   `json:"cmd"`
+	Count  int      `json:"count,omitempty"`
+	Addr   uint16   `json:"addr,omitempty"`
+	Length int      `json:"length,omitempty"`
+	Data   []byte   `json:"data,omitempty"`
+	Addrs  []uint16 `json:"addrs,omitempty"`
+	Reg    string   `json:"reg,omitempty"`
+	Value  uint16   `json:"value,omitempty"`
+}
+
+// DebugResponse answers request with the same id
+type DebugResponse struct {
+	ID     int    `json:"id"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Result any    `json:"result,omitempty"`
+}
+
+// DebugEvent is pushed to clients without request
+type DebugEvent struct {
+	Event   string `json:"event"`
+	PC      uint16 `json:"pc"`
+	Message string `json:"message,omitempty"`
+}
+
+// DebugRegisters is JSON view of cpu state
+type DebugRegisters struct {
+	A  uint8  `json:"a"`
+	B  uint8  `json:"b"`
+	C  uint8  `json:"c"`
+	D  uint8  `json:"d"`
+	E  uint8  `json:"e"`
+	H  uint8  `json:"h"`
+	L  uint8  `json:"l"`
+	SP uint16 `json:"sp"`
+	PC uint16 `json:"pc"`
+
+	S  uint8 `json:"s"`
+	Z  uint8 `json:"z"`
+	AC uint8 `json:"ac"`
+	P  uint8 `json:"p"`
+	CY uint8 `json:"cy"`
+	// V and K are undocumented 8085 flags, they are present only in 8085 mode
+	V *uint8 `json:"v,omitempty"`
+	K *uint8 `json:"k,omitempty"`
+
+	InterruptEnabled bool `json:"inte"`
+	Halted           bool `json:"halted"`
+}
+
+// DebugServer runs the cpu and accepts JSON commands over TCP,
+// every connected client receives events
+type DebugServer struct {
+	cpu *Cpu
+	// Step executes one instruction, it is cpu.Step by default. Boards replace it
+	// so their devices and interrupts advance together with cpu
+	Step func() error
+
+	mu          sync.Mutex
+	breakpoints map[uint16]bool
+	running     bool
+	stop        chan struct{}
+
+	clientsLock sync.Mutex
+	clients     map[net.Conn]*sync.Mutex
+}
+
+func NewDebugServer(cpu *Cpu) *DebugServer {
+	return &DebugServer{
+		cpu:         cpu,
+		Step:        cpu.Step,
+		breakpoints: map[uint16]bool{},
+		clients:     map[net.Conn]*sync.Mutex{},
+	}
+}
+
+func (srv *DebugServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("debug server is listening on %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *DebugServer) serveConn(conn net.Conn) {
+	writeLock := &sync.Mutex{}
+	srv.clientsLock.Lock()
+	srv.clients[conn] = writeLock
+	srv.clientsLock.Unlock()
+
+	defer func() {
+		srv.clientsLock.Lock()
+		delete(srv.clients, conn)
+		srv.clientsLock.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req DebugRequest
+		var resp DebugResponse
+
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp = srv.handle(req)
+		}
+
+		writeLock.Lock()
+		err := json.NewEncoder(conn).Encode(resp)
+		writeLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (srv *DebugServer) broadcast(event DebugEvent) {
+	srv.clientsLock.Lock()
+	defer srv.clientsLock.Unlock()
+
+	for conn, writeLock := range srv.clients {
+		writeLock.Lock()
+		json.NewEncoder(conn).Encode(event)
+		writeLock.Unlock()
+	}
+}
+
+func (srv *DebugServer) handle(req DebugRequest) DebugResponse {
+	resp := DebugResponse{ID: req.ID}
+	var err error
+
+	switch req.Cmd {
+	case "step":
+		resp.Result, err = srv.step(req.Count)
+	case "continue":
+		err = srv.cont()
+	case "pause":
+		srv.pause()
+	case "getRegisters":
+		srv.mu.Lock()
+		resp.Result = srv.registers()
+		srv.mu.Unlock()
+	case "setRegister":
+		err = srv.setRegister(req.Reg, req.Value)
+	case "readMemory":
+		if req.Length <= 0 {
+			err = fmt.Errorf("length must be positive")
+			break
+		}
+		// reading stops at the end of address space
+		length := min(req.Length, 0x10000-int(req.Addr))
+		srv.mu.Lock()
+		resp.Result = srv.cpu.CopyMemory(req.Addr, req.Addr+uint16(length-1))
+		srv.mu.Unlock()
+	case "writeMemory":
+		// ROM and memory above RAM ignore writes, the whole range must be writable
+		end := int(req.Addr) + len(req.Data) - 1
+		if len(req.Data) > 0 && (req.Addr <= ROMend || end >= int(RAMend)) {
+			err = fmt.Errorf("0x%04x-0x%04x is outside of RAM 0x%04x-0x%04x", req.Addr, end, ROMend+1, RAMend-1)
+			break
+		}
+		srv.mu.Lock()
+		for i, b := range req.Data {
+			srv.cpu.memory.write(req.Addr+uint16(i), b)
+		}
+		srv.mu.Unlock()
+	case "setBreakpoints":
+		srv.mu.Lock()
+		srv.breakpoints = map[uint16]bool{}
+		for _, addr := range req.Addrs {
+			srv.breakpoints[addr] = true
+		}
+		srv.mu.Unlock()
+	case "getFramebuffer":
+		srv.mu.Lock()
+		resp.Result = srv.cpu.CopyFrameBuffer()
+		srv.mu.Unlock()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Cmd)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.OK = true
+	}
+	return resp
+}
+
+func (srv *DebugServer) step(count int) (DebugRegisters, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.running {
+		return DebugRegisters{}, fmt.Errorf("cpu is running")
+	}
+	if count == 0 {
+		count = 1
+	}
+	// halted cpu is stepped too, it burns cycles until interrupt wakes it
+	for i := 0; i < count; i++ {
+		if err := srv.Step(); err != nil && !errors.As(err, new(*HaltedError)) {
+			return srv.registers(), err
+		}
+	}
+	return srv.registers(), nil
+}
+
+// cont runs cpu in background until breakpoint or pause
+func (srv *DebugServer) cont() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.running {
+		return fmt.Errorf("cpu is already running")
+	}
+	srv.running = true
+	srv.stop = make(chan struct{})
+	go srv.run(srv.stop)
+	return nil
+}
+
+// run steps cpu also while it is halted, halted event is sent when it halts
+// and running stops only on breakpoint, pause or error
+func (srv *DebugServer) run(stop chan struct{}) {
+	srv.mu.Lock()
+	wasHalted := srv.cpu.halted
+	srv.mu.Unlock()
+	for {
+		select {
+		case <-stop:
+			srv.mu.Lock()
+			pc := srv.cpu.pc
+			srv.mu.Unlock()
+			srv.broadcast(DebugEvent{Event: EventStopped, PC: pc})
+			return
+		default:
+		}
+
+		srv.mu.Lock()
+		err := srv.Step()
+		pc := srv.cpu.pc
+		halted := srv.cpu.halted
+		hit := !halted && srv.breakpoints[pc]
+		failed := err != nil && !errors.As(err, new(*HaltedError))
+		if hit || failed {
+			srv.running = false
+		}
+		srv.mu.Unlock()
+
+		if failed {
+			srv.broadcast(DebugEvent{Event: EventError, PC: pc, Message: err.Error()})
+			return
+		}
+		if halted && !wasHalted {
+			srv.broadcast(DebugEvent{Event: EventHalted, PC: pc})
+		}
+		wasHalted = halted
+		if hit {
+			srv.broadcast(DebugEvent{Event: EventBreakpoint, PC: pc})
+			return
+		}
+	}
+}
+
+func (srv *DebugServer) pause() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.running {
+		srv.running = false
+		close(srv.stop)
+	}
+}
+
+func (srv *DebugServer) registers() DebugRegisters {
+	cpu := srv.cpu
+	regs := DebugRegisters{
+		A: cpu.regs.a, B: cpu.regs.b, C: cpu.regs.c, D: cpu.regs.d,
+		E: cpu.regs.e, H: cpu.regs.h, L: cpu.regs.l,
+		SP: cpu.sp, PC: cpu.pc,
+		S: cpu.flags.s, Z: cpu.flags.z, AC: cpu.flags.ac, P: cpu.flags.p, CY: cpu.flags.cy,
+		InterruptEnabled: cpu.InterruptEnabled,
+		Halted:           cpu.halted,
+	}
+	if cpu.Model == decoder.I8085 {
+		v, k := cpu.flags.v, cpu.flags.k
+		regs.V, regs.K = &v, &k
+	}
+	return regs
+}
+
+func (srv *DebugServer) setRegister(name string, val uint16) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	cpu := srv.cpu
+	name = strings.ToLower(name)
+	if (name == "v" || name == "k") && cpu.Model != decoder.I8085 {
+		return fmt.Errorf("flag %q exists only on 8085", name)
+	}
+	switch name {
+	case "a":
+		cpu.regs.a = uint8(val)
+	case "b":
+		cpu.regs.b = uint8(val)
+	case "c":
+		cpu.regs.c = uint8(val)
+	case "d":
+		cpu.regs.d = uint8(val)
+	case "e":
+		cpu.regs.e = uint8(val)
+	case "h":
+		cpu.regs.h = uint8(val)
+	case "l":
+		cpu.regs.l = uint8(val)
+	case "sp":
+		cpu.sp = val
+	case "pc":
+		cpu.pc = val
+	case "s":
+		cpu.flags.s = uint8(val) & 1
+	case "z":
+		cpu.flags.z = uint8(val) & 1
+	case "ac":
+		cpu.flags.ac = uint8(val) & 1
+	case "p":
+		cpu.flags.p = uint8(val) & 1
+	case "cy":
+		cpu.flags.cy = uint8(val) & 1
+	case "v":
+		cpu.flags.v = uint8(val) & 1
+	case "k":
+		cpu.flags.k = uint8(val) & 1
+	default:
+		return fmt.Errorf("unknown register %q", name)
+	}
+	return nil
+}
@@ -2,13 +2,12 @@ package machine
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type proceeder interface {
@@ -18,28 +17,24 @@ type proceeder interface {
 type debugger struct {
 	instructionExec proceeder
 	advanceOP       *int
+	// Step executes one instruction, cpu.Step is used when it is nil. Boards set it
+	// so their devices and interrupts advance together with cpu
+	Step func() error
 }
 
 type defaultProceeder struct{}
 
-type remoteProceeder struct {
-	conn       net.Conn
-	ptrAdvance *int
-}
-
-func (rmp *remoteProceeder) next() {
-	n, s := getInput()
-	fmt.Println(n)
-	*rmp.ptrAdvance = n
-	rmp.conn.Write([]byte(s))
-}
-
 func (defp defaultProceeder) next() {
 	getInput()
 }
 
-func (dbg debugger) Debug(cpu *Cpu) {
-	for cpu.pc < uint16(MemorySize) {
+// Debug steps cpu also while it is halted, interrupt from board wakes it
+func (dbg debugger) Debug(cpu Processor) {
+	step := dbg.Step
+	if step == nil {
+		step = cpu.Step
+	}
+	for cpu.GetPC() < uint16(MemorySize) {
 		disassebmle(cpu)
 		debugCpuState(cpu)
 		if *dbg.advanceOP == 0 {
@@ -47,7 +42,14 @@ func (dbg debugger) Debug(cpu *Cpu) {
 		} else {
 			*dbg.advanceOP -= 1
 		}
-		cpu.Step()
+		wasHalted := cpu.IsHalted()
+		if err := step(); err != nil && !errors.As(err, new(*HaltedError)) {
+			fmt.Println(err)
+			return
+		}
+		if !wasHalted && cpu.IsHalted() {
+			fmt.Printf("CPU halted at PC: 0x%02x\n", cpu.GetPC())
+		}
 	}
 }
 
@@ -55,19 +57,11 @@ func (dbg debugger) advance() {
 	dbg.instructionExec.next()
 }
 
-func InitDebugger(flag string) debugger {
-	dbg := debugger{advanceOP: new(int)}
-
-	if flag == "-rd" {
-		dbg.instructionExec = &remoteProceeder{
-			conn:       connRemoteDbg(),
-			ptrAdvance: dbg.advanceOP,
-		}
-	} else {
-		dbg.instructionExec = defaultProceeder{}
+func InitDebugger() debugger {
+	return debugger{
+		advanceOP:       new(int),
+		instructionExec: defaultProceeder{},
 	}
-
-	return dbg
 }
 
 func getInput() (int, string) {
@@ -99,31 +93,25 @@ func getInput() (int, string) {
 	}
 }
 
-func connRemoteDbg() net.Conn {
-	for {
-		conn, err := net.Dial("tcp", "127.0.0.1:8080")
-		if err != nil {
-			time.Sleep(200 * time.Millisecond)
-			fmt.Println(err)
-		} else {
-			return conn
-		}
-	}
-}
-
-func disassebmle(cpuState *Cpu) {
-	pc := cpuState.pc
-	opcode := getOpcode(*cpuState.memory, pc)
+func disassebmle(cpuState Processor) {
+	pc := cpuState.GetPC()
+	opcode := cpuState.Disassemble(pc)
 	fmt.Printf("PC: 0x%02x\n", pc)
-	fmt.Printf("SP: 0x%02x\n", cpuState.sp)
+	fmt.Printf("SP: 0x%02x\n", cpuState.GetSP())
 	fmt.Printf("Instruction: %s ", opcode.Name)
-	fmt.Printf("          Immediate: 0x%02x\n", cpuState.memory[pc+1])
+	fmt.Printf("          Immediate: 0x%02x\n", cpuState.GetMemoryAt(pc+1))
 }
 
-func debugCpuState(cpu *Cpu) {
-	fmt.Printf(" A: %d\n B: %d\n C: %d\n D: %d\n E: %d\n H: %d\n L: %d\n", cpu.regs.a, cpu.regs.b, cpu.regs.c, cpu.regs.d, cpu.regs.e, cpu.regs.h, cpu.regs.l)
-	fmt.Printf(" SP: %02x\n PC: %02x \n", cpu.sp, cpu.pc)
-	fmt.Printf(" flags: sign - %d, zero - %d, aux carry - %d, parity - %d, carry - %d  \n", cpu.flags.s, cpu.flags.z, cpu.flags.ac, cpu.flags.p, cpu.flags.cy)
+func debugCpuState(cpu Processor) {
+	var flags []string
+	for _, reg := range cpu.Registers() {
+		if reg.Bits == 1 {
+			flags = append(flags, reg.String())
+			continue
+		}
+		fmt.Printf(" %s\n", reg)
+	}
+	fmt.Printf(" flags: %s\n", strings.Join(flags, " "))
 	fmt.Println("=========================================================================")
 
 }
@@ -0,0 +1,45 @@
+package machine
+
+import "fmt"
+
+// UnknownOpcodeError is returned when opcode at PC can't be executed
+type UnknownOpcodeError struct {
+	PC     uint16
+	Opcode uint8
+}
+
+func (e *UnknownOpcodeError) Error() string {
+	return fmt.Sprintf("unknown opcode 0x%02x at pc 0x%04x", e.Opcode, e.PC)
+}
+
+// BusError is returned when IN/OUT instruction accesses port with no device attached
+type BusError struct {
+	PC     uint16
+	Opcode uint8
+	Port   uint8
+}
+
+func (e *BusError) Error() string {
+	return fmt.Sprintf("no device on port 0x%02x, opcode 0x%02x at pc 0x%04x", e.Port, e.Opcode, e.PC)
+}
+
+// HaltedError is returned by the step which executed HLT,
+// cpu stays halted until interrupt
+type HaltedError struct {
+	PC     uint16
+	Opcode uint8
+}
+
+func (e *HaltedError) Error() string {
+	return fmt.Sprintf("cpu halted, opcode 0x%02x at pc 0x%04x", e.Opcode, e.PC)
+}
+
+// BDOSExitError is returned when CP/M program calls BDOS system reset
+type BDOSExitError struct {
+	PC     uint16
+	Opcode uint8
+}
+
+func (e *BDOSExitError) Error() string {
+	return fmt.Sprintf("BDOS exit, opcode 0x%02x at pc 0x%04x", e.Opcode, e.PC)
+}
@@ -2,13 +2,15 @@ package machine
 
 import (
 	"cpu-emulator/decoder"
-	"log"
+	misc "cpu-emulator/utils"
 	"math/bits"
 )
 
 // flags Z (zero), S (sign), P (parity), CY (carry), CA (auxillary  carry)
+// V (overflow) and K (underflow indicator) exist only on 8085
 type flags struct {
 	s, z, ac, p, cy uint8
+	v, k            uint8
 }
 
 func parity(val uint8) uint8 {
@@ -40,6 +42,61 @@ func (cpu *Cpu) updateFlags(val uint8, carry ...uint8) {
 	cpu.flags.p = parity(val)
 }
 
+// psw returns flags byte pushed by PUSH PSW: S Z 0 AC 0 P 1 CY.
+// 8085 stores V in bit 1 and K in bit 5 instead of the fixed bits
+func (cpu *Cpu) psw() uint8 {
+	psw := cpu.flags.cy | cpu.flags.p<<2 | cpu.flags.ac<<4 | cpu.flags.z<<6 | cpu.flags.s<<7
+	if cpu.Model == decoder.I8085 {
+		return psw | cpu.flags.v<<1 | cpu.flags.k<<5
+	}
+	return psw | 0x02
+}
+
+func (cpu *Cpu) setPSW(psw uint8) {
+	cpu.flags.cy = psw & 0x1
+	cpu.flags.p = (psw >> 2) & 0x1
+	cpu.flags.ac = (psw >> 4) & 0x1
+	cpu.flags.z = (psw >> 6) & 0x1
+	cpu.flags.s = (psw >> 7) & 0x1
+	if cpu.Model == decoder.I8085 {
+		cpu.flags.v = (psw >> 1) & 0x1
+		cpu.flags.k = (psw >> 5) & 0x1
+	}
+}
+
+// addFlags returns x + y + cy and sets all flags, AC is carry out of bit 3
+func (cpu *Cpu) addFlags(x, y, cy uint8) uint8 {
+	res, carry := misc.OverflowingAdd(x, y, cy)
+	cpu.updateFlags(res, carry)
+	cpu.setAux((x&0x0F)+(y&0x0F)+cy > 0x0F)
+	cpu.setOverflow(x, y, res, false)
+	return res
+}
+
+// subFlags returns x - y - borrow and sets all flags. 8080 subtracts by adding
+// two's complement, CY is inverted carry and AC is carry out of bit 3 of that addition
+func (cpu *Cpu) subFlags(x, y, borrow uint8) uint8 {
+	res, carry := misc.OverflowingSub(x, y, borrow)
+	cpu.updateFlags(res, carry)
+	cpu.setAux((x&0x0F)+(^y&0x0F)+(1-borrow) > 0x0F)
+	cpu.setOverflow(x, y, res, true)
+	return res
+}
+
+// logicFlags sets flags after ANA, XRA and ORA which always clear CY
+func (cpu *Cpu) logicFlags(res uint8, aux bool) {
+	cpu.updateFlags(res, 0)
+	cpu.setAux(aux)
+}
+
+// andAux is AC after ANA/ANI: 8080 sets it to OR of bit 3 of operands, 8085 always sets it
+func (cpu *Cpu) andAux(x, y uint8) bool {
+	if cpu.Model == decoder.I8085 {
+		return true
+	}
+	return (x|y)&0x08 != 0
+}
+
 func (cpu *Cpu) setAux(expression bool) {
 	if expression {
 		cpu.flags.ac = 1
@@ -84,7 +141,7 @@ func (cpu *Cpu) checkConditionFlag() bool {
 			return cpu.flags.p == 1
 		}
 	default:
-		log.Fatal("Error! Unknown condition flag")
+		cpu.fault = &UnknownOpcodeError{PC: cpu.pc, Opcode: cpu.currentOp.Code}
 		return false
 	}
 }
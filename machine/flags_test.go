@@ -0,0 +1,146 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+	"math/bits"
+	"testing"
+)
+
+// flag bits of PSW pushed by PUSH PSW
+const (
+	pswCY = 0x01
+	pswP  = 0x04
+	pswAC = 0x10
+	pswZ  = 0x40
+	pswS  = 0x80
+)
+
+// alu8080 is reference model of arithmetic and logic group from 8080/8085 datasheets.
+// It returns accumulator and flags in PSW layout without the fixed and 8085 only bits
+func alu8080(model decoder.CPUModel, op, a, b, cy uint8) (uint8, uint8) {
+	if op != 1 && op != 3 {
+		cy = 0
+	}
+
+	var res, f uint8
+	switch op {
+	case 0, 1:
+		sum := int(a) + int(b) + int(cy)
+		res = uint8(sum)
+		f = flagIf(int(a&0xf)+int(b&0xf)+int(cy) > 0xf, pswAC) | flagIf(sum > 0xff, pswCY)
+	case 2, 3, 7:
+		// subtraction adds two's complement of operand, CY is borrow
+		res = a - b - cy
+		f = flagIf(int(a&0xf)+int(^b&0xf)+int(1-cy) > 0xf, pswAC) | flagIf(int(a) < int(b)+int(cy), pswCY)
+	case 4:
+		res = a & b
+		f = flagIf(model == decoder.I8085 || (a|b)&0x08 != 0, pswAC)
+	case 5:
+		res = a ^ b
+	case 6:
+		res = a | b
+	}
+
+	f |= res&pswS | flagIf(res == 0, pswZ) | flagIf(bits.OnesCount8(res)%2 == 0, pswP)
+	if op == 7 {
+		return a, f
+	}
+	return res, f
+}
+
+// daa8080 follows DAA description of 8080 datasheet, the second correction
+// looks at high nibble after the first one
+func daa8080(a uint8, ac, cy bool) (uint8, uint8) {
+	res := int(a)
+	var f uint8
+	if a&0xf > 9 || ac {
+		f |= flagIf(a&0xf+6 > 0xf, pswAC)
+		res += 6
+	}
+	if res>>4 > 9 || cy {
+		res += 0x60
+		f |= pswCY
+	}
+
+	acc := uint8(res)
+	return acc, f | acc&pswS | flagIf(acc == 0, pswZ) | flagIf(bits.OnesCount8(acc)%2 == 0, pswP)
+}
+
+func TestArithmeticFlags(t *testing.T) {
+	names := []string{"ADD", "ADC", "SUB", "SBB", "ANA", "XRA", "ORA", "CMP"}
+	for _, model := range []decoder.CPUModel{decoder.I8080, decoder.I8085} {
+		cpu := InitCpu()
+		cpu.Model = model
+		for op := uint8(0); op < 8; op++ {
+			// op B
+			cpu.memory[0] = 0x80 | op<<3
+			for a := 0; a < 0x100; a++ {
+				for b := 0; b < 0x100; b++ {
+					for cy := uint8(0); cy < 2; cy++ {
+						cpu.pc = 0
+						cpu.regs.a, cpu.regs.b = uint8(a), uint8(b)
+						cpu.setPSW(cy)
+						if err := cpu.Step(); err != nil {
+							t.Fatal(err)
+						}
+						wantA, wantF := alu8080(model, op, uint8(a), uint8(b), cy)
+						gotF := cpu.psw() & (pswS | pswZ | pswAC | pswP | pswCY)
+						if cpu.regs.a != wantA || gotF != wantF {
+							t.Fatalf("%s %s a=%02x b=%02x cy=%d: got a=%02x f=%02x, want a=%02x f=%02x",
+								model, names[op], a, b, cy, cpu.regs.a, gotF, wantA, wantF)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDAA(t *testing.T) {
+	cpu := InitCpu()
+	// DAA
+	cpu.memory[0] = 0x27
+	for a := 0; a < 0x100; a++ {
+		for _, ac := range []bool{false, true} {
+			for _, cy := range []bool{false, true} {
+				cpu.pc = 0
+				cpu.regs.a = uint8(a)
+				cpu.setPSW(flagIf(ac, pswAC) | flagIf(cy, pswCY))
+				if err := cpu.Step(); err != nil {
+					t.Fatal(err)
+				}
+				wantA, wantF := daa8080(uint8(a), ac, cy)
+				if cpu.regs.a != wantA || cpu.psw() != wantF|0x02 {
+					t.Fatalf("a=%02x ac=%t cy=%t: got a=%02x psw=%02x, want a=%02x psw=%02x",
+						a, ac, cy, cpu.regs.a, cpu.psw(), wantA, wantF|0x02)
+				}
+			}
+		}
+	}
+}
+
+func TestPushPopPSW(t *testing.T) {
+	cpu := InitCpu()
+	// POP PSW; PUSH PSW
+	cpu.memory[0], cpu.memory[1] = 0xf1, 0xf5
+	for psw := 0; psw < 0x100; psw++ {
+		cpu.pc, cpu.sp = 0, 0x2100
+		cpu.memory[0x2100], cpu.memory[0x2101] = uint8(psw), 0x5a
+		for i := 0; i < 2; i++ {
+			if err := cpu.Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pushed := cpu.memory[0x2100]
+		if pushed&0x02 == 0 || pushed&0x28 != 0 {
+			t.Errorf("POP %02x: PUSH PSW stored %02x, bit 1 must be set and bits 3 and 5 clear", psw, pushed)
+		}
+		if want := uint8(psw)&0xd5 | 0x02; pushed != want {
+			t.Errorf("POP %02x: PUSH PSW stored %02x, want %02x", psw, pushed, want)
+		}
+		if cpu.regs.a != 0x5a || cpu.memory[0x2101] != 0x5a {
+			t.Errorf("accumulator %02x, pushed %02x, want 5a", cpu.regs.a, cpu.memory[0x2101])
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+)
+
+// 8085 interrupt vectors
+const (
+	trapVector  uint16 = 0x24
+	rst55Vector uint16 = 0x2c
+	rst65Vector uint16 = 0x34
+	rst75Vector uint16 = 0x3c
+	rstvVector  uint16 = 0x40
+
+	// ackCycles8085 are clock periods of TRAP and RST 5.5-7.5 acknowledge, the same as RST
+	ackCycles8085 = 12
+)
+
+// interrupt mask bits set by SIM, set bit disables interrupt
+const (
+	mask55 uint8 = 1 << iota
+	mask65
+	mask75
+)
+
+// intel8085 holds state of the 8085 interrupt and serial pins
+type intel8085 struct {
+	mask         uint8
+	trapPending  bool
+	rst75Pending bool
+	rst65Level   bool
+	rst55Level   bool
+
+	sid bool
+	sod bool
+
+	// sodHandler is called every time SIM changes serial output
+	sodHandler func(sod bool)
+}
+
+// Trap raises non maskable TRAP interrupt
+func (cpu *Cpu) Trap() {
+	cpu.i8085.trapPending = true
+}
+
+// RST75 latches rising edge on RST 7.5 input
+func (cpu *Cpu) RST75() {
+	cpu.i8085.rst75Pending = true
+}
+
+// SetRST65 sets level of RST 6.5 input
+func (cpu *Cpu) SetRST65(level bool) {
+	cpu.i8085.rst65Level = level
+}
+
+// SetRST55 sets level of RST 5.5 input
+func (cpu *Cpu) SetRST55(level bool) {
+	cpu.i8085.rst55Level = level
+}
+
+// SetSID sets level of serial input pin read by RIM
+func (cpu *Cpu) SetSID(level bool) {
+	cpu.i8085.sid = level
+}
+
+// SOD returns level of serial output pin written by SIM
+func (cpu *Cpu) SOD() bool {
+	return cpu.i8085.sod
+}
+
+func (cpu *Cpu) SetSODHandler(handler func(sod bool)) {
+	cpu.i8085.sodHandler = handler
+}
+
+// service8085Interrupts accepts highest priority pending interrupt
+func (cpu *Cpu) service8085Interrupts() {
+	state := &cpu.i8085
+
+	switch {
+	case state.trapPending:
+		state.trapPending = false
+		cpu.acceptInterrupt(trapVector)
+	case !cpu.InterruptEnabled || cpu.eiDelay:
+	case state.rst75Pending && state.mask&mask75 == 0:
+		state.rst75Pending = false
+		cpu.acceptInterrupt(rst75Vector)
+	case state.rst65Level && state.mask&mask65 == 0:
+		cpu.acceptInterrupt(rst65Vector)
+	case state.rst55Level && state.mask&mask55 == 0:
+		cpu.acceptInterrupt(rst55Vector)
+	}
+}
+
+// acceptInterrupt takes as long as RST, the first instruction of handler runs in the same Step
+func (cpu *Cpu) acceptInterrupt(vector uint16) {
+	cpu.cycles += ackCycles8085
+	cpu.halted = false
+	cpu.pushWord(cpu.pc)
+	cpu.pc = vector
+	cpu.InterruptEnabled = false
+
+	if cpu.Profiler != nil {
+		cpu.Profiler.interrupt(cpu.pc)
+	}
+}
+
+func boolToBit(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// setOverflow updates 8085 V and K flags after 8 bit arithmetic
+func (cpu *Cpu) setOverflow(x, y, res uint8, sub bool) {
+	var overflow uint8
+	if sub {
+		overflow = (x ^ y) & (x ^ res) & 0x80
+	} else {
+		overflow = ^(x ^ y) & (x ^ res) & 0x80
+	}
+	cpu.flags.v = boolToBit(overflow != 0)
+	cpu.flags.k = cpu.flags.v ^ (res >> 7)
+}
+
+// read interrupt mask
+func (cpu *Cpu) rim() uint8 {
+	state := &cpu.i8085
+	cpu.regs.a = boolToBit(state.sid)<<7 |
+		boolToBit(state.rst75Pending)<<6 |
+		boolToBit(state.rst65Level)<<5 |
+		boolToBit(state.rst55Level)<<4 |
+		boolToBit(cpu.InterruptEnabled)<<3 |
+		state.mask&0x7
+	return 1
+}
+
+// set interrupt mask
+func (cpu *Cpu) sim() uint8 {
+	state := &cpu.i8085
+	accum := cpu.regs.a
+
+	if accum&0x08 != 0 {
+		state.mask = accum & 0x7
+	}
+	if accum&0x10 != 0 {
+		state.rst75Pending = false
+	}
+	if accum&0x40 != 0 {
+		state.sod = accum&0x80 != 0
+		if state.sodHandler != nil {
+			state.sodHandler(state.sod)
+		}
+	}
+	return 1
+}
+
+// HL = HL - BC
+func (cpu *Cpu) dsub() uint8 {
+	hl := cpu.getPair(HL_REG)
+	bc := cpu.getPair(BC_REG)
+	res := hl - bc
+
+	cpu.updatePairRegs(HL_REG, uint8(res>>8), uint8(res))
+	cpu.flags.cy = boolToBit(hl < bc)
+	cpu.flags.z = boolToBit(res == 0)
+	cpu.flags.s = uint8(res >> 15)
+	cpu.flags.p = parity(uint8(res))
+	cpu.setAux(hl&0x0F < bc&0x0F)
+	cpu.flags.v = boolToBit((hl^bc)&(hl^res)&0x8000 != 0)
+	cpu.flags.k = cpu.flags.v ^ cpu.flags.s
+	return 1
+}
+
+// arithmetic shift right of HL, bit 0 goes to carry
+func (cpu *Cpu) arhl() uint8 {
+	hl := cpu.getPair(HL_REG)
+	cpu.flags.cy = uint8(hl & 1)
+	res := (hl >> 1) | (hl & 0x8000)
+	cpu.updatePairRegs(HL_REG, uint8(res>>8), uint8(res))
+	return 1
+}
+
+// rotate DE left through carry
+func (cpu *Cpu) rdel() uint8 {
+	de := cpu.getPair(DE_REG)
+	res := de<<1 | uint16(cpu.flags.cy)
+	cpu.flags.cy = uint8(de >> 15)
+	cpu.flags.v = boolToBit((de^res)&0x8000 != 0)
+	cpu.updatePairRegs(DE_REG, uint8(res>>8), uint8(res))
+	return 1
+}
+
+// DE = HL + immediate
+func (cpu *Cpu) ldhi() uint8 {
+	res := cpu.getPair(HL_REG) + uint16(cpu.operand8())
+	cpu.updatePairRegs(DE_REG, uint8(res>>8), uint8(res))
+	return 2
+}
+
+// DE = SP + immediate
+func (cpu *Cpu) ldsi() uint8 {
+	res := cpu.sp + uint16(cpu.operand8())
+	cpu.updatePairRegs(DE_REG, uint8(res>>8), uint8(res))
+	return 2
+}
+
+// restart at 0x40 on overflow
+func (cpu *Cpu) rstv() uint8 {
+	if cpu.flags.v == 0 {
+		return 1
+	}
+	cpu.branchTaken()
+	cpu.pushWord(cpu.pc + 1)
+	cpu.pc = rstvVector
+	return 0
+}
+
+// store HL at address in DE
+func (cpu *Cpu) shlx() uint8 {
+	addr := cpu.getPair(DE_REG)
+	cpu.writeMem(addr, cpu.regs.l)
+	cpu.writeMem(addr+1, cpu.regs.h)
+	return 1
+}
+
+// load HL from address in DE
+func (cpu *Cpu) lhlx() uint8 {
+	addr := cpu.getPair(DE_REG)
+	cpu.regs.l = cpu.readMem(addr)
+	cpu.regs.h = cpu.readMem(addr + 1)
+	return 1
+}
+
+// JNK and JK jump on K flag
+func (cpu *Cpu) jk() uint8 {
+	k := cpu.flags.k == 1
+	if cpu.currentOp.Instruction == decoder.JNK {
+		k = !k
+	}
+	if k {
+		cpu.branchTaken()
+		cpu.pc = cpu.operand16()
+		return 0
+	}
+	return 3
+}
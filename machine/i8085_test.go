@@ -0,0 +1,298 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+	"testing"
+)
+
+func init8085() *Cpu {
+	cpu := InitCpu()
+	cpu.Model = decoder.I8085
+	cpu.pc, cpu.sp = 0x80, 0x2100
+	return cpu
+}
+
+func TestInterruptPriority8085(t *testing.T) {
+	tests := []struct {
+		name                      string
+		trap, rst75, rst65, rst55 bool
+		intr                      bool
+		mask                      uint8
+		enabled                   bool
+		wantVector                uint16
+	}{
+		{name: "TRAP ignores DI", trap: true, rst75: true, wantVector: trapVector},
+		{name: "TRAP before RST 7.5", trap: true, rst75: true, rst65: true, enabled: true, wantVector: trapVector},
+		{name: "RST 7.5 before 6.5 and 5.5", rst75: true, rst65: true, rst55: true, enabled: true, wantVector: rst75Vector},
+		{name: "RST 6.5 before 5.5", rst65: true, rst55: true, enabled: true, wantVector: rst65Vector},
+		{name: "RST 5.5 before INTR", rst55: true, intr: true, enabled: true, wantVector: rst55Vector},
+		{name: "masked RST 7.5 is skipped", rst75: true, rst65: true, mask: mask75, enabled: true, wantVector: rst65Vector},
+		{name: "all masked", rst75: true, rst65: true, rst55: true, mask: 0x7, enabled: true},
+		{name: "interrupts disabled", rst75: true, rst65: true, rst55: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := init8085()
+			if tt.trap {
+				cpu.Trap()
+			}
+			if tt.rst75 {
+				cpu.RST75()
+			}
+			cpu.SetRST65(tt.rst65)
+			cpu.SetRST55(tt.rst55)
+			if tt.intr {
+				cpu.GenerateInterrupt(1)
+			}
+			cpu.i8085.mask = tt.mask
+			cpu.InterruptEnabled = tt.enabled
+
+			if err := cpu.Step(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantVector == 0 {
+				if cpu.pc != 0x81 {
+					t.Errorf("interrupt accepted, pc %04x", cpu.pc)
+				}
+				return
+			}
+			// handler starts with NOP which runs in the same step
+			ret := uint16(cpu.memory[cpu.sp+1])<<8 | uint16(cpu.memory[cpu.sp])
+			if cpu.pc != tt.wantVector+1 || ret != 0x80 {
+				t.Errorf("pc %04x return %04x, want pc %04x return 0080", cpu.pc, ret, tt.wantVector+1)
+			}
+			if cycles := cpu.StepCycles(); cycles != ackCycles8085+4 {
+				t.Errorf("took %d cycles, want %d", cycles, ackCycles8085+4)
+			}
+			if cpu.InterruptEnabled {
+				t.Error("interrupts must be disabled by acknowledge")
+			}
+			if tt.intr && !cpu.InterruptPending() {
+				t.Error("INTR request must stay pending")
+			}
+		})
+	}
+}
+
+func TestRST75Latch(t *testing.T) {
+	cpu := init8085()
+	cpu.InterruptEnabled = true
+	cpu.RST75()
+	cpu.SetRST65(true)
+	cpu.i8085.mask = mask65
+	cpu.Step()
+	if cpu.pc != rst75Vector+1 || cpu.i8085.rst75Pending {
+		t.Fatalf("RST 7.5 not accepted or latch not cleared, pc %04x", cpu.pc)
+	}
+
+	// RST 6.5 is level, it is accepted again while the input stays high
+	cpu.pc = 0x80
+	cpu.i8085.mask = 0
+	for i := 0; i < 2; i++ {
+		cpu.InterruptEnabled = true
+		cpu.Step()
+		if cpu.pc != rst65Vector+1 {
+			t.Fatalf("RST 6.5 not accepted, pc %04x", cpu.pc)
+		}
+	}
+}
+
+func TestSIM(t *testing.T) {
+	tests := []struct {
+		name        string
+		a           uint8
+		wantMask    uint8
+		wantPending bool
+		wantSOD     bool
+		wantCalls   int
+	}{
+		{name: "MSE sets mask", a: 0x0d, wantMask: 0x5, wantPending: true},
+		{name: "mask unchanged without MSE", a: 0x05, wantMask: 0x2, wantPending: true},
+		{name: "R7.5 resets latch", a: 0x10, wantMask: 0x2},
+		{name: "SOE writes SOD", a: 0xc0, wantMask: 0x2, wantPending: true, wantSOD: true, wantCalls: 1},
+		{name: "SOD ignored without SOE", a: 0x80, wantMask: 0x2, wantPending: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := init8085()
+			// SIM
+			cpu.memory[0x80] = 0x30
+			cpu.regs.a = tt.a
+			cpu.i8085.mask = 0x2
+			cpu.RST75()
+			calls := 0
+			cpu.SetSODHandler(func(bool) { calls++ })
+
+			if err := cpu.Step(); err != nil {
+				t.Fatal(err)
+			}
+			state := cpu.i8085
+			if state.mask != tt.wantMask || state.rst75Pending != tt.wantPending || cpu.SOD() != tt.wantSOD || calls != tt.wantCalls {
+				t.Errorf("mask %d pending %t SOD %t calls %d, want mask %d pending %t SOD %t calls %d",
+					state.mask, state.rst75Pending, cpu.SOD(), calls, tt.wantMask, tt.wantPending, tt.wantSOD, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRIM(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(cpu *Cpu)
+		want  uint8
+	}{
+		{name: "all clear", setup: func(cpu *Cpu) {}, want: 0x00},
+		{name: "all set", setup: func(cpu *Cpu) {
+			// mask keeps pending interrupts from being accepted
+			cpu.i8085.mask = 0x7
+			cpu.InterruptEnabled = true
+			cpu.SetSID(true)
+			cpu.RST75()
+			cpu.SetRST65(true)
+			cpu.SetRST55(true)
+		}, want: 0xff},
+		{name: "mask after reset", setup: func(cpu *Cpu) { cpu.Reset(); cpu.pc = 0x80 }, want: 0x07},
+		{name: "pending RST 7.5 and SID", setup: func(cpu *Cpu) {
+			cpu.SetSID(true)
+			cpu.RST75()
+			cpu.i8085.mask = mask75
+		}, want: 0xc4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := init8085()
+			// RIM
+			cpu.memory[0x80] = 0x20
+			tt.setup(cpu)
+			if err := cpu.Step(); err != nil {
+				t.Fatal(err)
+			}
+			if cpu.regs.a != tt.want {
+				t.Errorf("RIM returned %02x, want %02x", cpu.regs.a, tt.want)
+			}
+		})
+	}
+}
+
+func TestUndocumented8085(t *testing.T) {
+	tests := []struct {
+		name       string
+		program    []byte
+		setup      func(cpu *Cpu)
+		check      func(cpu *Cpu) bool
+		wantCycles int
+	}{
+		{
+			name:    "DSUB",
+			program: []byte{0x08},
+			setup: func(cpu *Cpu) {
+				cpu.updatePairRegs(HL_REG, 0x00, 0x00)
+				cpu.updatePairRegs(BC_REG, 0x00, 0x01)
+			},
+			check:      func(cpu *Cpu) bool { return cpu.getPair(HL_REG) == 0xffff && cpu.flags.cy == 1 && cpu.flags.s == 1 },
+			wantCycles: 10,
+		},
+		{
+			name:       "ARHL",
+			program:    []byte{0x10},
+			setup:      func(cpu *Cpu) { cpu.updatePairRegs(HL_REG, 0x80, 0x03) },
+			check:      func(cpu *Cpu) bool { return cpu.getPair(HL_REG) == 0xc001 && cpu.flags.cy == 1 },
+			wantCycles: 7,
+		},
+		{
+			name:       "RDEL",
+			program:    []byte{0x18},
+			setup:      func(cpu *Cpu) { cpu.updatePairRegs(DE_REG, 0x80, 0x01) },
+			check:      func(cpu *Cpu) bool { return cpu.getPair(DE_REG) == 0x0002 && cpu.flags.cy == 1 && cpu.flags.v == 1 },
+			wantCycles: 10,
+		},
+		{
+			name:       "LDHI",
+			program:    []byte{0x28, 0x10},
+			setup:      func(cpu *Cpu) { cpu.updatePairRegs(HL_REG, 0x20, 0x00) },
+			check:      func(cpu *Cpu) bool { return cpu.getPair(DE_REG) == 0x2010 && cpu.pc == 0x82 },
+			wantCycles: 10,
+		},
+		{
+			name:       "LDSI",
+			program:    []byte{0x38, 0x10},
+			check:      func(cpu *Cpu) bool { return cpu.getPair(DE_REG) == 0x2110 && cpu.pc == 0x82 },
+			wantCycles: 10,
+		},
+		{
+			name:       "RSTV taken",
+			program:    []byte{0xcb},
+			setup:      func(cpu *Cpu) { cpu.flags.v = 1 },
+			check:      func(cpu *Cpu) bool { return cpu.pc == rstvVector && cpu.memory[cpu.sp] == 0x81 },
+			wantCycles: 12,
+		},
+		{
+			name:       "RSTV not taken",
+			program:    []byte{0xcb},
+			check:      func(cpu *Cpu) bool { return cpu.pc == 0x81 && cpu.sp == 0x2100 },
+			wantCycles: 6,
+		},
+		{
+			name:    "SHLX",
+			program: []byte{0xd9},
+			setup: func(cpu *Cpu) {
+				cpu.updatePairRegs(DE_REG, 0x22, 0x00)
+				cpu.updatePairRegs(HL_REG, 0x12, 0x34)
+			},
+			check:      func(cpu *Cpu) bool { return cpu.memory[0x2200] == 0x34 && cpu.memory[0x2201] == 0x12 },
+			wantCycles: 10,
+		},
+		{
+			name:    "LHLX",
+			program: []byte{0xed},
+			setup: func(cpu *Cpu) {
+				cpu.updatePairRegs(DE_REG, 0x22, 0x00)
+				cpu.memory[0x2200], cpu.memory[0x2201] = 0x34, 0x12
+			},
+			check:      func(cpu *Cpu) bool { return cpu.getPair(HL_REG) == 0x1234 },
+			wantCycles: 10,
+		},
+		{
+			name:       "JNK taken",
+			program:    []byte{0xdd, 0x34, 0x12},
+			check:      func(cpu *Cpu) bool { return cpu.pc == 0x1234 },
+			wantCycles: 10,
+		},
+		{
+			name:       "JNK not taken",
+			program:    []byte{0xdd, 0x34, 0x12},
+			setup:      func(cpu *Cpu) { cpu.flags.k = 1 },
+			check:      func(cpu *Cpu) bool { return cpu.pc == 0x83 },
+			wantCycles: 7,
+		},
+		{
+			name:       "JK taken",
+			program:    []byte{0xfd, 0x34, 0x12},
+			setup:      func(cpu *Cpu) { cpu.flags.k = 1 },
+			check:      func(cpu *Cpu) bool { return cpu.pc == 0x1234 },
+			wantCycles: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := init8085()
+			copy(cpu.memory[0x80:], tt.program)
+			if tt.setup != nil {
+				tt.setup(cpu)
+			}
+			if err := cpu.Step(); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cpu) {
+				t.Errorf("unexpected state pc %04x sp %04x", cpu.pc, cpu.sp)
+			}
+			if cycles := cpu.StepCycles(); cycles != tt.wantCycles {
+				t.Errorf("took %d cycles, want %d", cycles, tt.wantCycles)
+			}
+		})
+	}
+}
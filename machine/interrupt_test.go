@@ -0,0 +1,116 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+	"errors"
+	"testing"
+)
+
+func TestInterruptAcknowledge(t *testing.T) {
+	tests := []struct {
+		name    string
+		model   decoder.CPUModel
+		program []byte
+		// irq is put on data bus after raiseAfter steps
+		irq        []byte
+		raiseAfter int
+		steps      int
+
+		wantPC     uint16
+		wantReturn uint16
+		wantCycles int
+	}{
+		{
+			name:    "EI is followed by one instruction",
+			program: []byte{0xfb, 0x00, 0x00},
+			irq:     []byte{0xcf},
+			steps:   3, wantPC: 0x08, wantReturn: 2, wantCycles: 11,
+		},
+		{
+			name:    "request stays pending while disabled",
+			program: []byte{0xf3, 0x00, 0xfb, 0x00, 0x00},
+			irq:     []byte{0xd7},
+			steps:   5, wantPC: 0x10, wantReturn: 4, wantCycles: 11,
+		},
+		{
+			name:    "CALL from data bus",
+			program: []byte{0xfb, 0x00, 0x00},
+			irq:     []byte{0xcd, 0x34, 0x12},
+			steps:   3, wantPC: 0x1234, wantReturn: 2, wantCycles: 17,
+		},
+		{
+			name:    "CALL 0005 from data bus is not BDOS",
+			program: []byte{0xfb, 0x00, 0x00},
+			irq:     []byte{0xcd, 0x05, 0x00},
+			steps:   3, wantPC: 0x0005, wantReturn: 2, wantCycles: 17,
+		},
+		{
+			name:    "wake from HLT",
+			program: []byte{0xfb, 0x76, 0x00},
+			irq:     []byte{0xcf},
+			steps:   3, wantPC: 0x08, wantReturn: 2, wantCycles: 11,
+		},
+		{
+			name:       "wake from HLT after idle steps",
+			program:    []byte{0xfb, 0x76, 0x00},
+			irq:        []byte{0xff},
+			raiseAfter: 10,
+			steps:      11, wantPC: 0x38, wantReturn: 2, wantCycles: 11,
+		},
+		{
+			name:    "8085 RST acknowledge",
+			model:   decoder.I8085,
+			program: []byte{0xfb, 0x00, 0x00},
+			irq:     []byte{0xcf},
+			steps:   3, wantPC: 0x08, wantReturn: 2, wantCycles: 12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := InitCpu()
+			cpu.Model = tt.model
+			cpu.LoadRom(tt.program)
+			cpu.sp = 0x2100
+			acks := 0
+			cpu.InterruptAck = func() { acks++ }
+
+			for i := 0; i < tt.steps; i++ {
+				if i == tt.raiseAfter {
+					cpu.RaiseInterrupt(tt.irq...)
+				}
+				if err := cpu.Step(); err != nil && !errors.As(err, new(*HaltedError)) {
+					t.Fatal(err)
+				}
+				if i < tt.steps-1 && acks != 0 {
+					t.Fatalf("interrupt accepted at step %d", i+1)
+				}
+			}
+
+			ret := uint16(cpu.memory[cpu.sp+1])<<8 | uint16(cpu.memory[cpu.sp])
+			if acks != 1 || cpu.pc != tt.wantPC || ret != tt.wantReturn {
+				t.Errorf("acks %d pc %04x return %04x, want 1 ack pc %04x return %04x", acks, cpu.pc, ret, tt.wantPC, tt.wantReturn)
+			}
+			if cycles := cpu.StepCycles(); cycles != tt.wantCycles {
+				t.Errorf("acknowledge took %d cycles, want %d", cycles, tt.wantCycles)
+			}
+			if cpu.InterruptEnabled || cpu.InterruptPending() || cpu.IsHalted() {
+				t.Error("acknowledge must disable interrupts, clear request and wake cpu")
+			}
+		})
+	}
+}
+
+func TestClearInterrupt(t *testing.T) {
+	cpu := InitCpu()
+	cpu.LoadRom([]byte{0xfb, 0x00, 0x00})
+	cpu.sp = 0x2100
+	cpu.GenerateInterrupt(1)
+	cpu.Step()
+	cpu.ClearInterrupt()
+	cpu.Step()
+	cpu.Step()
+	if cpu.pc != 3 {
+		t.Errorf("cleared request was accepted, pc %04x", cpu.pc)
+	}
+}
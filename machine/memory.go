@@ -1,5 +1,7 @@
 package machine
 
+import "time"
+
 const MemorySize = uint16(0xFFFF)
 const (
 	VRAMStart uint16 = 0x2400
@@ -8,11 +10,20 @@ const (
 	ROMstart uint16 = 0
 	ROMend   uint16 = 0x1fff
 
+	WorkRAMStart uint16 = 0x2000
+	WorkRAMEnd   uint16 = 0x23FF
+
 	RAMend uint16 = 0x4000
 )
 
 // 64KB RAM
-type Memory [MemorySize]byte
+type Memory [int(MemorySize) + 1]byte
+
+// poke is a pending write requested from outside of the emulation goroutine
+type poke struct {
+	addr uint16
+	val  uint8
+}
 
 func (mem *Memory) write(addr uint16, val uint8) {
 	if ROMend >= addr {
@@ -32,6 +43,22 @@ func (mem *Memory) read(addr uint16) uint8 {
 	return mem[addr]
 }
 
+// readMem is memory read performed by instruction, it is visible to profiler
+func (cpu *Cpu) readMem(addr uint16) uint8 {
+	if cpu.Profiler != nil {
+		cpu.Profiler.read(addr)
+	}
+	return cpu.memory.read(addr)
+}
+
+// writeMem is memory write performed by instruction, it is visible to profiler
+func (cpu *Cpu) writeMem(addr uint16, val uint8) {
+	if cpu.Profiler != nil {
+		cpu.Profiler.write(addr)
+	}
+	cpu.memory.write(addr, val)
+}
+
 func (cpu *Cpu) LoadRom(buff []byte) {
 	copy(cpu.memory[:], buff)
 }
@@ -40,8 +67,75 @@ func (cpu *Cpu) GetMemoryAt(offset uint16) uint8 {
 	return cpu.memory.read(offset)
 }
 
+// SetMemoryAt queues a write which is applied before the next instruction,
+// so it is safe to call while the machine is running in another goroutine
+func (cpu *Cpu) SetMemoryAt(addr uint16, val uint8) {
+	cpu.pokeLock.Lock()
+	cpu.pokes = append(cpu.pokes, poke{addr: addr, val: val})
+	cpu.pokeLock.Unlock()
+}
+
+// memSnapshot is copy of memory and SP requested from outside of the emulation goroutine
+type memSnapshot struct {
+	mem  *Memory
+	sp   uint16
+	done chan struct{}
+}
+
+func (cpu *Cpu) applyPokes() {
+	cpu.pokeLock.Lock()
+	for _, p := range cpu.pokes {
+		cpu.memory.write(p.addr, p.val)
+	}
+	cpu.pokes = cpu.pokes[:0]
+	if cpu.snapshot != nil {
+		copy(cpu.snapshot.mem[:], cpu.memory[:])
+		cpu.snapshot.sp = cpu.sp
+		close(cpu.snapshot.done)
+		cpu.snapshot = nil
+	}
+	cpu.pokeLock.Unlock()
+}
+
+// SnapshotMemory copies memory into dst and returns SP before the next instruction, so it is
+// safe to call while the machine is running in another goroutine. ok is false when cpu
+// doesn't start next instruction within timeout, for example because it is paused
+func (cpu *Cpu) SnapshotMemory(dst *Memory, timeout time.Duration) (sp uint16, ok bool) {
+	req := &memSnapshot{mem: dst, done: make(chan struct{})}
+	cpu.pokeLock.Lock()
+	cpu.snapshot = req
+	cpu.pokeLock.Unlock()
+
+	select {
+	case <-req.done:
+		return req.sp, true
+	case <-time.After(timeout):
+	}
+
+	cpu.pokeLock.Lock()
+	defer cpu.pokeLock.Unlock()
+	if cpu.snapshot == req {
+		cpu.snapshot = nil
+		return 0, false
+	}
+	// served while timeout fired
+	return req.sp, true
+}
+
+// CopyMemory returns a snapshot of memory in range [start, end]
+func (cpu *Cpu) CopyMemory(start, end uint16) []byte {
+	buffer := make([]byte, int(end)-int(start)+1)
+	copy(buffer, cpu.memory[start:])
+	return buffer
+}
+
 func (cpu *Cpu) CopyFrameBuffer() []byte {
 	buffer := make([]byte, 7168)
 	copy(buffer, cpu.memory[VRAMStart:VRAMEnd])
 	return buffer
 }
+
+// ReadMemory copies memory starting at addr into dst without allocating
+func (cpu *Cpu) ReadMemory(addr uint16, dst []byte) {
+	copy(dst, cpu.memory[addr:])
+}
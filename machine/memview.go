@@ -0,0 +1,139 @@
+package machine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ansiClear     = "\033[H\033[2J"
+	ansiHome      = "\033[H"
+	ansiReverse   = "\033[7m"
+	ansiReset     = "\033[0m"
+	ansiClearLine = "\033[K"
+
+	stackViewDepth = 16
+	// snapshotTimeout is how long Render waits for the emulation goroutine
+	snapshotTimeout = 100 * time.Millisecond
+)
+
+// MemoryViewer renders live hex view of the work RAM and the stack
+// and lets user to poke values into running machine
+type MemoryViewer struct {
+	cpu *Cpu
+	out io.Writer
+
+	// Labels are named addresses which can be used instead of hex address in poke command
+	Labels map[string]uint16
+
+	mem  *Memory
+	prev []byte
+
+	// message is result of the last command, it is written by command reader
+	message     string
+	messageLock sync.Mutex
+}
+
+func NewMemoryViewer(cpu *Cpu, out io.Writer) *MemoryViewer {
+	return &MemoryViewer{
+		cpu:    cpu,
+		out:    out,
+		Labels: map[string]uint16{},
+		mem:    &Memory{},
+	}
+}
+
+// Run redraws view every interval and reads poke commands from stdin
+func (mv *MemoryViewer) Run(interval time.Duration) {
+	fmt.Fprint(mv.out, ansiClear)
+	go mv.readCommands(os.Stdin)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mv.Render()
+	}
+}
+
+// Render draws single frame, bytes changed since previous frame are highlighted.
+// Nothing is drawn when the machine doesn't run, the last frame stays on screen
+func (mv *MemoryViewer) Render() {
+	sp, ok := mv.cpu.SnapshotMemory(mv.mem, snapshotTimeout)
+	if !ok {
+		return
+	}
+	ram := make([]byte, int(WorkRAMEnd-WorkRAMStart)+1)
+	copy(ram, mv.mem[WorkRAMStart:])
+	var sb strings.Builder
+
+	sb.WriteString(ansiHome)
+	sb.WriteString("WORK RAM\n")
+	for row := 0; row < len(ram); row += 16 {
+		fmt.Fprintf(&sb, "%04x: ", int(WorkRAMStart)+row)
+		for col := 0; col < 16; col++ {
+			i := row + col
+			if mv.prev != nil && mv.prev[i] != ram[i] {
+				fmt.Fprintf(&sb, "%s%02x%s ", ansiReverse, ram[i], ansiReset)
+			} else {
+				fmt.Fprintf(&sb, "%02x ", ram[i])
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\nSTACK\n")
+	for i := uint16(0); i < stackViewDepth; i += 2 {
+		addr := sp + i
+		val := uint16(mv.mem[addr]) | uint16(mv.mem[addr+1])<<8
+		fmt.Fprintf(&sb, "%04x: %04x%s\n", addr, val, ansiClearLine)
+	}
+
+	mv.messageLock.Lock()
+	fmt.Fprintf(&sb, "\n%s%s\n", mv.message, ansiClearLine)
+	mv.messageLock.Unlock()
+	sb.WriteString("poke: w <addr|label> <value>" + ansiClearLine + "\n")
+
+	mv.prev = ram
+	fmt.Fprint(mv.out, sb.String())
+}
+
+func (mv *MemoryViewer) readCommands(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		message := mv.execCommand(scanner.Text())
+		mv.messageLock.Lock()
+		mv.message = message
+		mv.messageLock.Unlock()
+	}
+}
+
+func (mv *MemoryViewer) execCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "w" {
+		return fmt.Sprintf("unknown command %q", line)
+	}
+
+	addr, ok := mv.Labels[fields[1]]
+	if !ok {
+		n, err := strconv.ParseUint(fields[1], 16, 16)
+		if err != nil {
+			return fmt.Sprintf("invalid address %q", fields[1])
+		}
+		addr = uint16(n)
+	}
+
+	val, err := strconv.ParseUint(fields[2], 16, 8)
+	if err != nil {
+		return fmt.Sprintf("invalid value %q", fields[2])
+	}
+
+	mv.cpu.SetMemoryAt(addr, uint8(val))
+	return fmt.Sprintf("wrote 0x%02x to 0x%04x", val, addr)
+}
@@ -0,0 +1,70 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+	"fmt"
+)
+
+// Processor is execution interface shared by Cpu and Z80 cores,
+// debuggers and loaders work with either of them
+type Processor interface {
+	Step() error
+	LoadRom(buff []byte)
+	GenerateInterrupt(interruptNum int)
+
+	GetPC() uint16
+	GetSP() uint16
+	IsHalted() bool
+	GetMemoryAt(addr uint16) uint8
+	GetCurrentOP() *decoder.Opcode
+
+	// Disassemble decodes instruction at addr with mnemonics of the core
+	Disassemble(addr uint16) *decoder.Opcode
+	// Registers returns registers and flags in fixed order
+	Registers() []Register
+}
+
+// Register is value of cpu register or flag shown by debuggers
+type Register struct {
+	Name  string
+	Value uint16
+	// Bits is 1 for flags, 8 or 16 for registers
+	Bits uint8
+}
+
+func (reg Register) String() string {
+	switch reg.Bits {
+	case 1:
+		return fmt.Sprintf("%s=%d", reg.Name, reg.Value)
+	case 8:
+		return fmt.Sprintf("%s: %02x", reg.Name, reg.Value)
+	}
+	return fmt.Sprintf("%s: %04x", reg.Name, reg.Value)
+}
+
+func (cpu *Cpu) Disassemble(addr uint16) *decoder.Opcode {
+	return cpu.decode(addr)
+}
+
+func (cpu *Cpu) Registers() []Register {
+	regs := []Register{
+		{"A", uint16(cpu.regs.a), 8},
+		{"B", uint16(cpu.regs.b), 8},
+		{"C", uint16(cpu.regs.c), 8},
+		{"D", uint16(cpu.regs.d), 8},
+		{"E", uint16(cpu.regs.e), 8},
+		{"H", uint16(cpu.regs.h), 8},
+		{"L", uint16(cpu.regs.l), 8},
+		{"SP", cpu.sp, 16},
+		{"PC", cpu.pc, 16},
+		{"S", uint16(cpu.flags.s), 1},
+		{"Z", uint16(cpu.flags.z), 1},
+		{"AC", uint16(cpu.flags.ac), 1},
+		{"P", uint16(cpu.flags.p), 1},
+		{"CY", uint16(cpu.flags.cy), 1},
+	}
+	if cpu.Model == decoder.I8085 {
+		regs = append(regs, Register{"V", uint16(cpu.flags.v), 1}, Register{"K", uint16(cpu.flags.k), 1})
+	}
+	return append(regs, Register{"INTE", uint16(boolToBit(cpu.InterruptEnabled)), 1})
+}
@@ -0,0 +1,235 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const profilerMaxDepth = 256
+
+// RoutineStats is time spent in subroutine entered by CALL, RST or interrupt
+type RoutineStats struct {
+	Addr        uint16
+	Calls       uint64
+	SelfCycles  uint64
+	TotalCycles uint64
+}
+
+// Profiler collects code/data coverage and cycles spent per routine.
+// Attach it to Cpu.Profiler before running
+type Profiler struct {
+	executed [0x10000]uint64
+	code     [0x10000]bool
+	reads    [0x10000]uint64
+	writes   [0x10000]uint64
+	opcodes  [256]uint64
+
+	routines    map[uint16]*RoutineStats
+	callStack   []uint16
+	totalCycles uint64
+
+	// range of currently executed instruction, reads inside it are operand fetches
+	opStart uint16
+	opSize  uint16
+	spPrev  uint16
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		routines:  map[uint16]*RoutineStats{},
+		callStack: []uint16{ROMstart},
+	}
+}
+
+func (p *Profiler) routine(addr uint16) *RoutineStats {
+	r, ok := p.routines[addr]
+	if !ok {
+		r = &RoutineStats{Addr: addr}
+		p.routines[addr] = r
+	}
+	return r
+}
+
+func (p *Profiler) beforeStep(cpu *Cpu) {
+	op := cpu.currentOp
+	pc := cpu.pc
+
+	p.opStart = pc
+	p.opSize = uint16(op.Size)
+	p.spPrev = cpu.sp
+
+	p.executed[pc]++
+	p.opcodes[op.Code]++
+	for i := uint16(0); i < p.opSize; i++ {
+		p.code[pc+i] = true
+	}
+}
+
+func (p *Profiler) afterStep(cpu *Cpu) {
+	op := cpu.currentOp
+
+	// cycles are known when instruction completed, taken branches take longer
+	cycles := uint64(cpu.cycles)
+	p.totalCycles += cycles
+	p.routine(p.callStack[len(p.callStack)-1]).SelfCycles += cycles
+	for _, addr := range p.callStack {
+		p.routine(addr).TotalCycles += cycles
+	}
+
+	// taken call pushes return address, taken return pops it
+	if isCall(op) && cpu.sp == p.spPrev-2 {
+		p.enter(cpu.pc)
+	} else if isRet(op) && cpu.sp == p.spPrev+2 && len(p.callStack) > 1 {
+		p.callStack = p.callStack[:len(p.callStack)-1]
+	}
+}
+
+func (p *Profiler) interrupt(addr uint16) {
+	p.enter(addr)
+}
+
+func (p *Profiler) enter(addr uint16) {
+	p.routine(addr).Calls++
+	if len(p.callStack) >= profilerMaxDepth {
+		p.callStack = append(p.callStack[:1], p.callStack[2:]...)
+	}
+	p.callStack = append(p.callStack, addr)
+}
+
+func (p *Profiler) read(addr uint16) {
+	if addr-p.opStart < p.opSize {
+		return
+	}
+	p.reads[addr]++
+}
+
+func (p *Profiler) write(addr uint16) {
+	p.writes[addr]++
+}
+
+func (p *Profiler) class(addr uint16) string {
+	read := p.reads[addr] > 0
+	written := p.writes[addr] > 0
+
+	switch {
+	case p.code[addr] && written:
+		return "code+written"
+	case p.code[addr]:
+		return "code"
+	case read && written:
+		return "read+written"
+	case read:
+		return "data"
+	case written:
+		return "written"
+	default:
+		return "unused"
+	}
+}
+
+// WriteCoverageMap writes ranges of memory in [start, end] grouped by access kind
+func (p *Profiler) WriteCoverageMap(w io.Writer, start, end uint16) {
+	rangeStart := int(start)
+	rangeClass := p.class(start)
+
+	for addr := int(start) + 1; addr <= int(end)+1; addr++ {
+		var class string
+		if addr <= int(end) {
+			class = p.class(uint16(addr))
+			if class == rangeClass {
+				continue
+			}
+		}
+		fmt.Fprintf(w, "%04x-%04x %s\n", rangeStart, addr-1, rangeClass)
+		rangeStart = addr
+		rangeClass = class
+	}
+}
+
+// WriteDisassembly writes linear disassembly of [start, end] annotated with execution counts.
+// Instructions which were never executed are marked with '-', bytes read as data are shown as DB
+func (p *Profiler) WriteDisassembly(w io.Writer, cpu *Cpu, start, end uint16) {
+	mem := cpu.memory
+	for addr := int(start); addr <= int(end); {
+		a := uint16(addr)
+
+		if p.executed[a] == 0 && !p.code[a] && p.reads[a] > 0 {
+			fmt.Fprintf(w, "  %10s  %04x  %02x         DB 0x%02x\n", "data", a, mem.read(a), mem.read(a))
+			addr++
+			continue
+		}
+
+		op := cpu.decode(a)
+		var raw strings.Builder
+		for i := uint16(0); i < uint16(op.Size); i++ {
+			fmt.Fprintf(&raw, "%02x ", mem.read(a+i))
+		}
+
+		marker := " "
+		count := fmt.Sprint(p.executed[a])
+		if p.executed[a] == 0 {
+			marker = "-"
+			count = ""
+		}
+		fmt.Fprintf(w, "%s %10s  %04x  %-9s  %s\n", marker, count, a, raw.String(), op.Name)
+		addr += int(op.Size)
+	}
+}
+
+// Hotspots returns routines sorted by total cycles spent in them
+func (p *Profiler) Hotspots() []RoutineStats {
+	var stats []RoutineStats
+	for _, r := range p.routines {
+		stats = append(stats, *r)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalCycles > stats[j].TotalCycles
+	})
+	return stats
+}
+
+// WriteHotspots writes n most expensive routines
+func (p *Profiler) WriteHotspots(w io.Writer, n int) {
+	fmt.Fprintf(w, "%-8s %10s %14s %14s %7s\n", "routine", "calls", "self cycles", "total cycles", "total%")
+	for i, r := range p.Hotspots() {
+		if i == n {
+			break
+		}
+		percent := 0.0
+		if p.totalCycles > 0 {
+			percent = float64(r.TotalCycles) * 100 / float64(p.totalCycles)
+		}
+		fmt.Fprintf(w, "0x%04x   %10d %14d %14d %6.2f%%\n", r.Addr, r.Calls, r.SelfCycles, r.TotalCycles, percent)
+	}
+}
+
+// WriteOpcodeCoverage lists opcodes which were never executed
+func (p *Profiler) WriteOpcodeCoverage(w io.Writer) {
+	var missing []string
+	executed := 0
+	for code := 0; code < 256; code++ {
+		if p.opcodes[code] > 0 {
+			executed++
+		} else {
+			missing = append(missing, fmt.Sprintf("%02x", code))
+		}
+	}
+	fmt.Fprintf(w, "executed %d of 256 opcodes\n", executed)
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "never executed: %s\n", strings.Join(missing, " "))
+	}
+}
+
+// WriteReport writes all sections for ROM area of cpu memory
+func (p *Profiler) WriteReport(w io.Writer, cpu *Cpu) {
+	fmt.Fprintln(w, "== HOT SPOTS ==")
+	p.WriteHotspots(w, 30)
+	fmt.Fprintln(w, "\n== OPCODE COVERAGE ==")
+	p.WriteOpcodeCoverage(w)
+	fmt.Fprintln(w, "\n== COVERAGE MAP ==")
+	p.WriteCoverageMap(w, ROMstart, RAMend-1)
+	fmt.Fprintln(w, "\n== DISASSEMBLY ==")
+	p.WriteDisassembly(w, cpu, ROMstart, ROMend)
+}
@@ -2,7 +2,6 @@ package machine
 
 import (
 	misc "cpu-emulator/utils"
-	"log"
 )
 
 const (
@@ -44,8 +43,6 @@ func (cpu *Cpu) updatePairRegs(register uint8, msb, lsb uint8) {
 		cpu.regs.l = lsb
 	case SP_REG:
 		cpu.sp = misc.Make16bit(msb, lsb)
-	default:
-		log.Fatalf("Invalid register pair %d", register)
 	}
 }
 
@@ -57,12 +54,9 @@ func (cpu *Cpu) getPair(dest uint8) uint16 {
 		return misc.Make16bit(cpu.regs.d, cpu.regs.e)
 	case HL_REG:
 		return misc.Make16bit(cpu.regs.h, cpu.regs.l)
-	case SP_REG:
-		return cpu.sp
 	default:
-		log.Fatalf("Unknown pair %s", dest)
+		return cpu.sp
 	}
-	return 0
 }
 
 func (cpu *Cpu) GetReg(reg uint8) uint8 {
@@ -83,7 +77,7 @@ func (cpu *Cpu) GetReg(reg uint8) uint8 {
 		return cpu.regs.a
 	case MEM_REG:
 		addr := cpu.getPair(reg)
-		return cpu.memory.read(addr)
+		return cpu.readMem(addr)
 	}
 	return 0
 }
@@ -106,8 +100,6 @@ func (cpu *Cpu) updateReg(reg uint8, val uint8) {
 		cpu.regs.a = val
 	case MEM_REG:
 		addr := cpu.getPair(HL_REG)
-		cpu.memory.write(addr, val)
-	default:
-		log.Fatalf("Invalid register %d", reg)
+		cpu.writeMem(addr, val)
 	}
 }
@@ -0,0 +1,78 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"slices"
+)
+
+// screen of Space Invaders board, monitor is rotated so every 32 bytes of VRAM are one column
+const (
+	ScreenWidth  = 224
+	ScreenHeight = 256
+)
+
+// ReadVRAM returns copy of video RAM of any core
+func ReadVRAM(cpu Processor) []byte {
+	vram := make([]byte, ScreenWidth*ScreenHeight/8)
+	for i := range vram {
+		vram[i] = cpu.GetMemoryAt(VRAMStart + uint16(i))
+	}
+	return vram
+}
+
+// VRAMImage decodes video RAM into 1-bit image as it is seen on screen
+func VRAMImage(vram []byte) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, ScreenWidth, ScreenHeight), color.Palette{color.Black, color.White})
+	for x := 0; x < ScreenWidth; x++ {
+		for y := 0; y < ScreenHeight; y++ {
+			b := vram[x*ScreenHeight/8+y/8]
+			if b>>(y%8)&1 == 1 {
+				img.SetColorIndex(x, ScreenHeight-1-y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// WritePNG encodes img as PNG with text written as tEXt chunks after the header
+func WritePNG(w io.Writer, img image.Image, text map[string]string) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	// signature and IHDR chunk (length, type, 13 bytes of data and crc) come first
+	encoded := buf.Bytes()
+	headerEnd := 8 + 4 + 4 + 13 + 4
+	if _, err := w.Write(encoded[:headerEnd]); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(text))
+	for key := range text {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := writeChunk(w, "tEXt", []byte(key+"\x00"+text[key])); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(encoded[headerEnd:])
+	return err
+}
+
+func writeChunk(w io.Writer, kind string, data []byte) error {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := w.Write(chunk)
+	return err
+}
@@ -0,0 +1,73 @@
+package machine
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ShiftRegister is external 16 bit shift hardware of Midway 8080 boards (MB14241).
+// Writes to DataPort shift new byte into high half, writes to OffsetPort set offset
+// and ResultPort reads 8 bits starting at offset from the top
+type ShiftRegister struct {
+	OffsetPort uint8
+	DataPort   uint8
+	ResultPort uint8
+
+	lock   sync.Mutex
+	value  uint16
+	offset uint8
+}
+
+// NewShiftRegister returns shift register on ports used by Space Invaders and most Midway boards
+func NewShiftRegister() *ShiftRegister {
+	return &ShiftRegister{OffsetPort: 2, DataPort: 4, ResultPort: 3}
+}
+
+func (s *ShiftRegister) In(port uint8) uint8 {
+	if port != s.ResultPort {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return uint8(s.value >> (8 - s.offset))
+}
+
+func (s *ShiftRegister) Out(port uint8, val uint8) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch port {
+	case s.OffsetPort:
+		s.offset = val & 0x7
+	case s.DataPort:
+		s.value = uint16(val)<<8 | s.value>>8
+	}
+}
+
+// Reset clears shifted data and offset
+func (s *ShiftRegister) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.value = 0
+	s.offset = 0
+}
+
+// MarshalBinary saves state as 16 bit value (little endian) followed by offset
+func (s *ShiftRegister) MarshalBinary() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return []byte{uint8(s.value), uint8(s.value >> 8), s.offset}, nil
+}
+
+func (s *ShiftRegister) UnmarshalBinary(data []byte) error {
+	if len(data) != 3 {
+		return fmt.Errorf("shift register state must be 3 bytes, got %d", len(data))
+	}
+	if data[2] > 7 {
+		return fmt.Errorf("shift register offset %d out of range", data[2])
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.value = uint16(data[1])<<8 | uint16(data[0])
+	s.offset = data[2]
+	return nil
+}
@@ -0,0 +1,109 @@
+package machine
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShiftRegister(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []uint8
+	}{
+		{"single write", []uint8{0xa5}},
+		{"two writes", []uint8{0x12, 0x34}},
+		{"older bytes drop out", []uint8{0xff, 0x00, 0x81, 0x7e}},
+		{"all ones", []uint8{0xff, 0xff}},
+		{"alternating", []uint8{0x55, 0xaa, 0x55}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value uint16
+			for _, w := range tt.writes {
+				value = uint16(w)<<8 | value>>8
+			}
+			for offset := uint8(0); offset < 8; offset++ {
+				s := NewShiftRegister()
+				for _, w := range tt.writes {
+					s.Out(s.DataPort, w)
+				}
+				// only 3 bits of offset are wired
+				s.Out(s.OffsetPort, offset|0xf8)
+				want := uint8(value << offset >> 8)
+				if got := s.In(s.ResultPort); got != want {
+					t.Errorf("offset %d: got %02x, want %02x", offset, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShiftRegisterOtherPorts(t *testing.T) {
+	s := NewShiftRegister()
+	s.Out(s.DataPort, 0xff)
+	s.Out(s.DataPort, 0xff)
+	s.Out(1, 0x00)
+	if got := s.In(s.ResultPort); got != 0xff {
+		t.Errorf("write to unrelated port changed result to %02x", got)
+	}
+	if got := s.In(s.DataPort); got != 0 {
+		t.Errorf("read of port other than result returned %02x", got)
+	}
+}
+
+func TestShiftRegisterReset(t *testing.T) {
+	s := NewShiftRegister()
+	s.Out(s.DataPort, 0x12)
+	s.Out(s.DataPort, 0x34)
+	s.Out(s.OffsetPort, 3)
+	s.Reset()
+
+	state, _ := s.MarshalBinary()
+	if !bytes.Equal(state, []byte{0, 0, 0}) {
+		t.Fatalf("state after reset %x", state)
+	}
+	s.Out(s.DataPort, 0xab)
+	if got := s.In(s.ResultPort); got != 0xab {
+		t.Errorf("got %02x after reset, want ab with offset 0", got)
+	}
+}
+
+func TestShiftRegisterState(t *testing.T) {
+	s := NewShiftRegister()
+	s.Out(s.DataPort, 0x12)
+	s.Out(s.DataPort, 0x34)
+	s.Out(s.OffsetPort, 5)
+
+	state, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state, []byte{0x12, 0x34, 5}) {
+		t.Fatalf("state %x, want 123405", state)
+	}
+
+	restored := NewShiftRegister()
+	if err := restored.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restored.In(restored.ResultPort), s.In(s.ResultPort); got != want {
+		t.Errorf("restored register returns %02x, want %02x", got, want)
+	}
+	restored.Out(restored.DataPort, 0x56)
+	s.Out(s.DataPort, 0x56)
+	if got, want := restored.In(restored.ResultPort), s.In(s.ResultPort); got != want {
+		t.Errorf("after shift restored register returns %02x, want %02x", got, want)
+	}
+
+	for _, bad := range [][]byte{nil, {0x12, 0x34}, {0x12, 0x34, 5, 0}, {0x12, 0x34, 8}} {
+		r := NewShiftRegister()
+		r.Out(r.DataPort, 0x99)
+		if err := r.UnmarshalBinary(bad); err == nil {
+			t.Errorf("state %x accepted", bad)
+		}
+		if got, _ := r.MarshalBinary(); !bytes.Equal(got, []byte{0, 0x99, 0}) {
+			t.Errorf("rejected state %x changed register to %x", bad, got)
+		}
+	}
+}
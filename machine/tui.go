@@ -0,0 +1,499 @@
+package machine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	ansiBold = "\033[1m"
+
+	tuiHistoryLen   = 4
+	tuiDisasmLen    = 16
+	tuiStackDepth   = 8
+	tuiMemoryRows   = 8
+	tuiContinueTick = 10_000
+	tuiScrollRows   = tuiMemoryRows * 16
+)
+
+// keys which come as escape sequences
+const (
+	keyUp       = "up"
+	keyDown     = "down"
+	keyPageUp   = "pgup"
+	keyPageDown = "pgdn"
+)
+
+// TUI is full screen terminal debugger. It draws only with ANSI escape codes
+// so it works in any terminal including over SSH
+type TUI struct {
+	cpu Processor
+	out io.Writer
+	// Step executes one instruction, it is cpu.Step by default. Boards replace it
+	// so their devices and interrupts advance together with cpu
+	Step func() error
+
+	breakpoints map[uint16]bool
+	history     []uint16
+	// prev registers are used to highlight changes between steps
+	prev    []Register
+	memAddr uint16
+	message string
+
+	keys chan string
+	// prompt is shown while argument of command is typed, command runs with input on enter
+	prompt  string
+	command string
+	input   []byte
+
+	// ROMHash is SHA-256 of loaded ROM stored in screenshots
+	ROMHash string
+}
+
+func InitTUI(cpu Processor, out io.Writer) *TUI {
+	return &TUI{
+		cpu:         cpu,
+		out:         out,
+		Step:        cpu.Step,
+		breakpoints: map[uint16]bool{},
+		memAddr:     WorkRAMStart,
+		keys:        make(chan string),
+	}
+}
+
+// Run starts reading keys from stdin and processes them until quit
+func (tui *TUI) Run() {
+	restore := rawTerminal()
+	defer restore()
+	go tui.readKeys(os.Stdin)
+
+	fmt.Fprint(tui.out, ansiClear)
+	tui.prev = tui.cpu.Registers()
+	tui.Render()
+
+	for key := range tui.keys {
+		if !tui.handleKey(key) {
+			return
+		}
+		tui.Render()
+	}
+}
+
+// rawTerminal switches terminal to single key input without echo and returns function which
+// restores it, nothing is changed when stdin is not a terminal
+func rawTerminal() func() {
+	saved, err := stty("-g")
+	if err != nil {
+		return func() {}
+	}
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return func() {}
+	}
+	return func() { stty(strings.TrimSpace(saved)) }
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// readKeys sends every key, arrows and page keys are sent by name
+func (tui *TUI) readKeys(in io.Reader) {
+	r := bufio.NewReader(in)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if b != '\033' || r.Buffered() == 0 {
+			tui.keys <- string(b)
+			continue
+		}
+		// escape sequence is ESC [ params final
+		seq := []byte{}
+		for r.Buffered() > 0 {
+			c, _ := r.ReadByte()
+			seq = append(seq, c)
+			if len(seq) > 1 && (c >= 'A' && c <= 'Z' || c == '~') {
+				break
+			}
+		}
+		switch string(seq) {
+		case "[A":
+			tui.keys <- keyUp
+		case "[B":
+			tui.keys <- keyDown
+		case "[5~":
+			tui.keys <- keyPageUp
+		case "[6~":
+			tui.keys <- keyPageDown
+		}
+	}
+	close(tui.keys)
+}
+
+// handleKey runs command bound to key or edits argument of prompted command
+func (tui *TUI) handleKey(key string) bool {
+	if tui.prompt != "" {
+		tui.editInput(key)
+		return true
+	}
+
+	switch key {
+	case "\r", "\n", " ", "s":
+		return tui.execCommand("s")
+	case "n":
+		tui.ask("steps", "s")
+	case "c":
+		return tui.execCommand("c")
+	case "b":
+		tui.ask("breakpoint address (enter for pc)", "b")
+	case "m":
+		tui.ask("memory address", "m")
+	case "p":
+		tui.ask("screenshot file", "shot")
+	case keyUp:
+		tui.memAddr -= 16
+	case keyDown:
+		tui.memAddr += 16
+	case keyPageUp, "[":
+		tui.memAddr -= tuiScrollRows
+	case keyPageDown, "]":
+		tui.memAddr += tuiScrollRows
+	case "q", "\x03", "\x04":
+		return false
+	}
+	return true
+}
+
+// ask shows prompt and runs command with typed argument on enter
+func (tui *TUI) ask(prompt, command string) {
+	tui.prompt = prompt
+	tui.command = command
+	tui.input = tui.input[:0]
+	tui.message = ""
+}
+
+func (tui *TUI) editInput(key string) {
+	switch key {
+	case "\r", "\n":
+		cmd := tui.command + " " + string(tui.input)
+		tui.prompt = ""
+		tui.execCommand(cmd)
+	case "\033", "\x03":
+		tui.prompt = ""
+	case "\x7f", "\b":
+		if len(tui.input) > 0 {
+			tui.input = tui.input[:len(tui.input)-1]
+		}
+	default:
+		if len(key) == 1 && key[0] >= ' ' && key[0] < 0x7f {
+			tui.input = append(tui.input, key[0])
+		}
+	}
+}
+
+func (tui *TUI) execCommand(cmd string) bool {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		fields = []string{"s"}
+	}
+	tui.message = ""
+
+	switch fields[0] {
+	case "s":
+		count := 1
+		if len(fields) > 1 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				tui.message = fmt.Sprintf("invalid count %q", fields[1])
+				return true
+			}
+			count = n
+		}
+		tui.prev = tui.cpu.Registers()
+		for i := 0; i < count; i++ {
+			if err := tui.step(); err != nil {
+				tui.message = err.Error()
+				break
+			}
+		}
+	case "c":
+		tui.prev = tui.cpu.Registers()
+		tui.cont()
+	case "b":
+		if len(fields) == 1 {
+			fields = append(fields, fmt.Sprintf("%04x", tui.cpu.GetPC()))
+		}
+		addr, ok := tui.parseAddr(fields)
+		if !ok {
+			return true
+		}
+		if tui.breakpoints[addr] {
+			delete(tui.breakpoints, addr)
+			tui.message = fmt.Sprintf("breakpoint removed at 0x%04x", addr)
+		} else {
+			tui.breakpoints[addr] = true
+			tui.message = fmt.Sprintf("breakpoint set at 0x%04x", addr)
+		}
+	case "m":
+		addr, ok := tui.parseAddr(fields)
+		if !ok {
+			return true
+		}
+		tui.memAddr = addr
+	case "shot":
+		if len(fields) < 2 {
+			tui.message = "file is required"
+			return true
+		}
+		if err := tui.screenshot(fields[1]); err != nil {
+			tui.message = err.Error()
+		} else {
+			tui.message = "screenshot saved to " + fields[1]
+		}
+	case "q":
+		return false
+	default:
+		tui.message = fmt.Sprintf("unknown command %q", cmd)
+	}
+
+	return true
+}
+
+// screenshot saves VRAM as 1-bit PNG
+func (tui *TUI) screenshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	text := map[string]string{
+		"Software": "cpu-emulator",
+		"PC":       fmt.Sprintf("0x%04x", tui.cpu.GetPC()),
+	}
+	if tui.ROMHash != "" {
+		text["ROM SHA-256"] = tui.ROMHash
+	}
+	if err := WritePNG(f, VRAMImage(ReadVRAM(tui.cpu)), text); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (tui *TUI) parseAddr(fields []string) (uint16, bool) {
+	if len(fields) < 2 {
+		tui.message = "address is required"
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 16)
+	if err != nil {
+		tui.message = fmt.Sprintf("invalid address %q", fields[1])
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+func (tui *TUI) step() error {
+	tui.history = append(tui.history, tui.cpu.GetPC())
+	if len(tui.history) > tuiHistoryLen {
+		tui.history = tui.history[1:]
+	}
+	// halted cpu is stepped too, it burns cycles until interrupt wakes it
+	wasHalted := tui.cpu.IsHalted()
+	if err := tui.Step(); err != nil && !errors.As(err, new(*HaltedError)) {
+		return err
+	}
+	if !wasHalted && tui.cpu.IsHalted() {
+		tui.message = fmt.Sprintf("halted at 0x%04x", tui.cpu.GetPC())
+	}
+	return nil
+}
+
+// cont runs until breakpoint is hit, cpu fails or any key is pressed
+func (tui *TUI) cont() {
+	for i := 0; ; i++ {
+		if err := tui.step(); err != nil {
+			tui.message = err.Error()
+			return
+		}
+		if !tui.cpu.IsHalted() && tui.breakpoints[tui.cpu.GetPC()] {
+			tui.message = fmt.Sprintf("breakpoint hit at 0x%04x", tui.cpu.GetPC())
+			return
+		}
+
+		if i%tuiContinueTick == 0 {
+			select {
+			case <-tui.keys:
+				tui.message = "stopped"
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Render redraws all panes
+func (tui *TUI) Render() {
+	var sb strings.Builder
+	sb.WriteString(ansiHome)
+
+	disasm := tui.disassemblyPane()
+	regs := tui.registersPane()
+	for i := 0; i < len(disasm) || i < len(regs); i++ {
+		left, right := "", ""
+		if i < len(disasm) {
+			left = disasm[i]
+		}
+		if i < len(regs) {
+			right = regs[i]
+		}
+		fmt.Fprintf(&sb, "%s  %s%s\n", padVisible(left, 40), right, ansiClearLine)
+	}
+
+	sb.WriteString("\n")
+	for _, line := range tui.memoryPane() {
+		sb.WriteString(line + ansiClearLine + "\n")
+	}
+
+	fmt.Fprintf(&sb, "\n%s%s\n", tui.message, ansiClearLine)
+	sb.WriteString("[enter|s] step  [n] step n  [c] continue  [b] breakpoint  [m] memory  [arrows|pgup|pgdn] scroll  [p] screenshot  [q] quit" + ansiClearLine + "\n")
+	if tui.prompt != "" {
+		fmt.Fprintf(&sb, "%s: %s%s", tui.prompt, tui.input, ansiClearLine)
+	} else {
+		sb.WriteString(ansiClearLine)
+	}
+
+	fmt.Fprint(tui.out, sb.String())
+}
+
+func (tui *TUI) disassemblyLine(addr uint16) (string, uint16) {
+	op := tui.cpu.Disassemble(addr)
+
+	marker := "  "
+	if addr == tui.cpu.GetPC() {
+		marker = "> "
+	}
+	if tui.breakpoints[addr] {
+		marker = marker[:1] + "*"
+	}
+
+	var raw strings.Builder
+	for i := uint16(0); i < uint16(op.Size); i++ {
+		fmt.Fprintf(&raw, "%02x ", tui.cpu.GetMemoryAt(addr+i))
+	}
+
+	line := fmt.Sprintf("%s%04x  %-9s %s", marker, addr, raw.String(), op.Name)
+	if addr == tui.cpu.GetPC() {
+		line = ansiReverse + line + ansiReset
+	}
+	return line, addr + uint16(op.Size)
+}
+
+func (tui *TUI) disassemblyPane() []string {
+	lines := []string{ansiBold + "DISASSEMBLY" + ansiReset}
+
+	for _, addr := range tui.history {
+		line, _ := tui.disassemblyLine(addr)
+		lines = append(lines, line)
+	}
+
+	addr := tui.cpu.GetPC()
+	for i := 0; i < tuiDisasmLen; i++ {
+		var line string
+		line, addr = tui.disassemblyLine(addr)
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// padVisible pads string with spaces to width ignoring ANSI escape sequences
+func padVisible(s string, width int) string {
+	visible := 0
+	escape := false
+	for _, r := range s {
+		switch {
+		case r == '\033':
+			escape = true
+		case escape:
+			if r == 'm' {
+				escape = false
+			}
+		default:
+			visible++
+		}
+	}
+
+	if visible >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-visible)
+}
+
+func highlight(changed bool, s string) string {
+	if changed {
+		return ansiReverse + s + ansiReset
+	}
+	return s
+}
+
+func (tui *TUI) registersPane() []string {
+	lines := []string{ansiBold + "REGISTERS" + ansiReset}
+
+	var row, flags []string
+	for i, reg := range tui.cpu.Registers() {
+		changed := i >= len(tui.prev) || tui.prev[i].Value != reg.Value
+		if reg.Bits == 1 {
+			flags = append(flags, highlight(changed, reg.String()))
+			continue
+		}
+		row = append(row, highlight(changed, reg.String()))
+		if len(row) == 2 {
+			lines = append(lines, strings.Join(row, "  "))
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		lines = append(lines, row[0])
+	}
+
+	lines = append(lines,
+		strings.Join(flags, " "),
+		fmt.Sprintf("HALTED: %t", tui.cpu.IsHalted()),
+		"",
+		ansiBold+"STACK"+ansiReset,
+	)
+
+	sp := tui.cpu.GetSP()
+	for i := uint16(0); i < tuiStackDepth*2; i += 2 {
+		addr := sp + i
+		val := uint16(tui.cpu.GetMemoryAt(addr)) | uint16(tui.cpu.GetMemoryAt(addr+1))<<8
+		lines = append(lines, fmt.Sprintf("%04x: %04x", addr, val))
+	}
+
+	return lines
+}
+
+func (tui *TUI) memoryPane() []string {
+	lines := []string{ansiBold + "MEMORY" + ansiReset}
+	for row := uint16(0); row < tuiMemoryRows; row++ {
+		addr := tui.memAddr + row*16
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%04x: ", addr)
+		for col := uint16(0); col < 16; col++ {
+			fmt.Fprintf(&sb, "%02x ", tui.cpu.GetMemoryAt(addr+col))
+		}
+		lines = append(lines, sb.String())
+	}
+	return lines
+}
@@ -0,0 +1,55 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+	"strings"
+	"testing"
+)
+
+func TestUndocumented8080(t *testing.T) {
+	tests := []struct {
+		program    []byte
+		size       uint16
+		wantCycles int
+		wantPC     uint16
+		wantSP     uint16
+	}{
+		{program: []byte{0x08}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		{program: []byte{0x10}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		{program: []byte{0x18}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		{program: []byte{0x20}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		{program: []byte{0x28}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		{program: []byte{0x30}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		{program: []byte{0x38}, size: 1, wantCycles: 4, wantPC: 1, wantSP: 0x2100},
+		// JMP
+		{program: []byte{0xcb, 0x34, 0x12}, size: 3, wantCycles: 10, wantPC: 0x1234, wantSP: 0x2100},
+		// RET to address on stack
+		{program: []byte{0xd9}, size: 1, wantCycles: 10, wantPC: 0x0abc, wantSP: 0x2102},
+		// CALL
+		{program: []byte{0xdd, 0x34, 0x12}, size: 3, wantCycles: 17, wantPC: 0x1234, wantSP: 0x20fe},
+		{program: []byte{0xed, 0x34, 0x12}, size: 3, wantCycles: 17, wantPC: 0x1234, wantSP: 0x20fe},
+		{program: []byte{0xfd, 0x34, 0x12}, size: 3, wantCycles: 17, wantPC: 0x1234, wantSP: 0x20fe},
+	}
+
+	for _, tt := range tests {
+		cpu := InitCpu()
+		cpu.LoadRom(tt.program)
+		cpu.sp = 0x2100
+		cpu.memory[0x2100], cpu.memory[0x2101] = 0xbc, 0x0a
+
+		op := decoder.GetModelInstruction(decoder.I8080, cpu.memory[:], 0)
+		if !strings.HasPrefix(op.Name, "*") || uint16(op.Size) != tt.size {
+			t.Errorf("%02x: decoded as %q of size %d, want alias of size %d", tt.program[0], op.Name, op.Size, tt.size)
+		}
+		if err := cpu.Step(); err != nil {
+			t.Fatalf("%02x: %v", tt.program[0], err)
+		}
+		if cpu.pc != tt.wantPC || cpu.sp != tt.wantSP || cpu.StepCycles() != tt.wantCycles {
+			t.Errorf("%02x: pc %04x sp %04x cycles %d, want pc %04x sp %04x cycles %d", tt.program[0],
+				cpu.pc, cpu.sp, cpu.StepCycles(), tt.wantPC, tt.wantSP, tt.wantCycles)
+		}
+		if tt.wantSP == 0x20fe && cpu.memory[0x20fe] != 3 {
+			t.Errorf("%02x: pushed return %02x, want 03", tt.program[0], cpu.memory[0x20fe])
+		}
+	}
+}
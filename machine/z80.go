@@ -0,0 +1,1069 @@
+package machine
+
+import (
+	"cpu-emulator/decoder"
+	misc "cpu-emulator/utils"
+	"fmt"
+	"math/bits"
+)
+
+// Z80 flag bits, X and Y are undocumented copies of result bits 3 and 5
+const (
+	z80C  uint8 = 0x01
+	z80N  uint8 = 0x02
+	z80PV uint8 = 0x04
+	z80X  uint8 = 0x08
+	z80H  uint8 = 0x10
+	z80Y  uint8 = 0x20
+	z80Z  uint8 = 0x40
+	z80S  uint8 = 0x80
+)
+
+const z80NMIVector uint16 = 0x66
+
+type z80Registers struct {
+	a, f, b, c, d, e, h, l uint8
+}
+
+// Z80 is Zilog Z80 core implementing Processor. Unlike Cpu it sees memory
+// as flat 64KB RAM, which is what CP/M programs expect
+type Z80 struct {
+	currentOp *decoder.Opcode
+	memory    *Memory
+
+	regs z80Registers
+	// alt is alternate register set swapped by EX AF, AF' and EXX
+	alt z80Registers
+
+	ix, iy uint16
+	sp, pc uint16
+	i, r   uint8
+
+	iff1, iff2 bool
+	im         uint8
+
+	halted bool
+	// eiDelay blocks interrupts until instruction after EI completes
+	eiDelay bool
+	// irq is set by GenerateInterrupt, irqData is put on the bus when it is accepted
+	irq     bool
+	irqData uint8
+
+	// IO receives IN and OUT, only low byte of port address is used
+	IO Device
+
+	// opPC is address of current instruction
+	opPC uint16
+	// index points to IX or IY after DD/FD prefix, nil means HL
+	index *uint16
+	// addr is address of (HL) or (IX+d) operand, indexMem is set once displacement is read
+	addr     uint16
+	indexMem bool
+	fault    error
+}
+
+func InitZ80() *Z80 {
+	return &Z80{
+		memory: &Memory{},
+		regs:   z80Registers{a: 0xff, f: 0xff},
+		sp:     0xffff,
+	}
+}
+
+func (cpu *Z80) LoadRom(buff []byte) {
+	copy(cpu.memory[:], buff)
+}
+
+func (cpu *Z80) GetPC() uint16 {
+	return cpu.pc
+}
+
+func (cpu *Z80) GetSP() uint16 {
+	return cpu.sp
+}
+
+func (cpu *Z80) IsHalted() bool {
+	return cpu.halted
+}
+
+func (cpu *Z80) GetMemoryAt(addr uint16) uint8 {
+	return cpu.memory[addr]
+}
+
+func (cpu *Z80) GetCurrentOP() *decoder.Opcode {
+	return cpu.currentOp
+}
+
+func (cpu *Z80) Disassemble(addr uint16) *decoder.Opcode {
+	return decoder.GetZ80Instruction(cpu.memory[:], addr)
+}
+
+func (cpu *Z80) Registers() []Register {
+	flag := func(name string, mask uint8) Register {
+		return Register{name, uint16(boolToBit(cpu.regs.f&mask != 0)), 1}
+	}
+	return []Register{
+		{"A", uint16(cpu.regs.a), 8},
+		{"F", uint16(cpu.regs.f), 8},
+		{"B", uint16(cpu.regs.b), 8},
+		{"C", uint16(cpu.regs.c), 8},
+		{"D", uint16(cpu.regs.d), 8},
+		{"E", uint16(cpu.regs.e), 8},
+		{"H", uint16(cpu.regs.h), 8},
+		{"L", uint16(cpu.regs.l), 8},
+		{"AF'", misc.Make16bit(cpu.alt.a, cpu.alt.f), 16},
+		{"BC'", misc.Make16bit(cpu.alt.b, cpu.alt.c), 16},
+		{"DE'", misc.Make16bit(cpu.alt.d, cpu.alt.e), 16},
+		{"HL'", misc.Make16bit(cpu.alt.h, cpu.alt.l), 16},
+		{"IX", cpu.ix, 16},
+		{"IY", cpu.iy, 16},
+		{"SP", cpu.sp, 16},
+		{"PC", cpu.pc, 16},
+		{"I", uint16(cpu.i), 8},
+		{"R", uint16(cpu.r), 8},
+		{"IM", uint16(cpu.im), 8},
+		flag("S", z80S),
+		flag("Z", z80Z),
+		flag("H", z80H),
+		flag("PV", z80PV),
+		flag("N", z80N),
+		flag("C", z80C),
+		{"IFF1", uint16(boolToBit(cpu.iff1)), 1},
+		{"IFF2", uint16(boolToBit(cpu.iff2)), 1},
+	}
+}
+
+// Step executes single instruction. On error pc is left at the failed instruction
+func (cpu *Z80) Step() error {
+	if cpu.irq && cpu.Interrupt(cpu.irqData) {
+		cpu.irq = false
+		return nil
+	}
+	if cpu.halted {
+		return nil
+	}
+	cpu.opPC = cpu.pc
+	cpu.currentOp = cpu.Disassemble(cpu.pc)
+	cpu.eiDelay = false
+	cpu.fault = nil
+	cpu.index = nil
+	cpu.indexMem = false
+
+	cpu.execute()
+	if cpu.fault != nil {
+		cpu.pc = cpu.opPC
+		return cpu.fault
+	}
+	if cpu.halted {
+		return &HaltedError{PC: cpu.opPC, Opcode: cpu.currentOp.Code}
+	}
+	return nil
+}
+
+// Run executes instructions until any error, including HALT
+func (cpu *Z80) Run() error {
+	for {
+		if err := cpu.Step(); err != nil {
+			return err
+		}
+	}
+}
+
+// NMI accepts non maskable interrupt, IFF2 keeps interrupt state for RETN
+func (cpu *Z80) NMI() {
+	cpu.halted = false
+	cpu.iff1 = false
+	cpu.incR()
+	cpu.push(cpu.pc)
+	cpu.pc = z80NMIVector
+}
+
+// Interrupt accepts maskable interrupt with data put on the bus by device
+// and reports whether it was accepted. In IM 0 data must be RST instruction,
+// in IM 2 it is low byte of vector table address
+func (cpu *Z80) Interrupt(data uint8) bool {
+	if !cpu.iff1 || cpu.eiDelay {
+		return false
+	}
+	cpu.halted = false
+	cpu.iff1, cpu.iff2 = false, false
+	cpu.incR()
+	cpu.push(cpu.pc)
+
+	switch cpu.im {
+	case 0:
+		cpu.pc = uint16(data & 0x38)
+	case 1:
+		cpu.pc = 0x38
+	case 2:
+		cpu.pc = cpu.read16(uint16(cpu.i)<<8 | uint16(data))
+	}
+	return true
+}
+
+// GenerateInterrupt latches RST interruptNum the same way as on Cpu. Request stays pending
+// until interrupts are enabled and it is accepted by Step in place of the next instruction
+func (cpu *Z80) GenerateInterrupt(interruptNum int) {
+	cpu.irq = true
+	cpu.irqData = 0xc7 | uint8(interruptNum)<<3
+}
+
+func (cpu *Z80) read(addr uint16) uint8 {
+	return cpu.memory[addr]
+}
+
+func (cpu *Z80) write(addr uint16, val uint8) {
+	cpu.memory[addr] = val
+}
+
+func (cpu *Z80) read16(addr uint16) uint16 {
+	return misc.Make16bit(cpu.read(addr+1), cpu.read(addr))
+}
+
+func (cpu *Z80) write16(addr uint16, val uint16) {
+	cpu.write(addr, uint8(val))
+	cpu.write(addr+1, uint8(val>>8))
+}
+
+func (cpu *Z80) fetch() uint8 {
+	val := cpu.read(cpu.pc)
+	cpu.pc++
+	return val
+}
+
+func (cpu *Z80) fetch16() uint16 {
+	lsb := cpu.fetch()
+	return misc.Make16bit(cpu.fetch(), lsb)
+}
+
+// fetchOpcode is M1 cycle which also refreshes low 7 bits of R
+func (cpu *Z80) fetchOpcode() uint8 {
+	cpu.incR()
+	return cpu.fetch()
+}
+
+func (cpu *Z80) incR() {
+	cpu.r = cpu.r&0x80 | (cpu.r+1)&0x7f
+}
+
+func (cpu *Z80) push(val uint16) {
+	cpu.sp -= 2
+	cpu.write16(cpu.sp, val)
+}
+
+func (cpu *Z80) pop() uint16 {
+	val := cpu.read16(cpu.sp)
+	cpu.sp += 2
+	return val
+}
+
+func (cpu *Z80) in(port uint8) uint8 {
+	if cpu.IO == nil {
+		cpu.fault = &BusError{PC: cpu.opPC, Opcode: cpu.currentOp.Code, Port: port}
+		return 0xff
+	}
+	return cpu.IO.In(port)
+}
+
+func (cpu *Z80) out(port uint8, val uint8) {
+	if cpu.IO == nil {
+		cpu.fault = &BusError{PC: cpu.opPC, Opcode: cpu.currentOp.Code, Port: port}
+		return
+	}
+	cpu.IO.Out(port, val)
+}
+
+func (cpu *Z80) bc() uint16 { return misc.Make16bit(cpu.regs.b, cpu.regs.c) }
+func (cpu *Z80) de() uint16 { return misc.Make16bit(cpu.regs.d, cpu.regs.e) }
+func (cpu *Z80) hl() uint16 { return misc.Make16bit(cpu.regs.h, cpu.regs.l) }
+
+func (cpu *Z80) setBC(val uint16) { cpu.regs.b, cpu.regs.c = uint8(val>>8), uint8(val) }
+func (cpu *Z80) setDE(val uint16) { cpu.regs.d, cpu.regs.e = uint8(val>>8), uint8(val) }
+func (cpu *Z80) setHL(val uint16) { cpu.regs.h, cpu.regs.l = uint8(val>>8), uint8(val) }
+
+// hlx returns HL or index register selected by prefix
+func (cpu *Z80) hlx() uint16 {
+	if cpu.index != nil {
+		return *cpu.index
+	}
+	return cpu.hl()
+}
+
+func (cpu *Z80) setHLX(val uint16) {
+	if cpu.index != nil {
+		*cpu.index = val
+		return
+	}
+	cpu.setHL(val)
+}
+
+// getPair returns BC, DE, HL or SP
+func (cpu *Z80) getPair(p uint8) uint16 {
+	switch p {
+	case 0:
+		return cpu.bc()
+	case 1:
+		return cpu.de()
+	case 2:
+		return cpu.hlx()
+	}
+	return cpu.sp
+}
+
+func (cpu *Z80) setPair(p uint8, val uint16) {
+	switch p {
+	case 0:
+		cpu.setBC(val)
+	case 1:
+		cpu.setDE(val)
+	case 2:
+		cpu.setHLX(val)
+	default:
+		cpu.sp = val
+	}
+}
+
+// getPair2 is getPair used by PUSH and POP where AF replaces SP
+func (cpu *Z80) getPair2(p uint8) uint16 {
+	if p == 3 {
+		return misc.Make16bit(cpu.regs.a, cpu.regs.f)
+	}
+	return cpu.getPair(p)
+}
+
+func (cpu *Z80) setPair2(p uint8, val uint16) {
+	if p == 3 {
+		cpu.regs.a, cpu.regs.f = uint8(val>>8), uint8(val)
+		return
+	}
+	cpu.setPair(p, val)
+}
+
+// memOperand returns address of (HL) or (IX+d), displacement is read from instruction
+func (cpu *Z80) memOperand() uint16 {
+	if cpu.index == nil {
+		return cpu.hl()
+	}
+	cpu.indexMem = true
+	disp := int8(cpu.fetch())
+	return *cpu.index + uint16(disp)
+}
+
+// getReg returns B, C, D, E, H, L, (HL) or A. After index prefix H and L
+// are halves of index register unless instruction also uses (IX+d)
+func (cpu *Z80) getReg(i uint8) uint8 {
+	switch i {
+	case 0:
+		return cpu.regs.b
+	case 1:
+		return cpu.regs.c
+	case 2:
+		return cpu.regs.d
+	case 3:
+		return cpu.regs.e
+	case 4:
+		if cpu.index != nil && !cpu.indexMem {
+			return uint8(*cpu.index >> 8)
+		}
+		return cpu.regs.h
+	case 5:
+		if cpu.index != nil && !cpu.indexMem {
+			return uint8(*cpu.index)
+		}
+		return cpu.regs.l
+	case 6:
+		return cpu.read(cpu.addr)
+	}
+	return cpu.regs.a
+}
+
+func (cpu *Z80) setReg(i uint8, val uint8) {
+	switch i {
+	case 0:
+		cpu.regs.b = val
+	case 1:
+		cpu.regs.c = val
+	case 2:
+		cpu.regs.d = val
+	case 3:
+		cpu.regs.e = val
+	case 4:
+		if cpu.index != nil && !cpu.indexMem {
+			*cpu.index = *cpu.index&0x00ff | uint16(val)<<8
+			return
+		}
+		cpu.regs.h = val
+	case 5:
+		if cpu.index != nil && !cpu.indexMem {
+			*cpu.index = *cpu.index&0xff00 | uint16(val)
+			return
+		}
+		cpu.regs.l = val
+	case 6:
+		cpu.write(cpu.addr, val)
+	default:
+		cpu.regs.a = val
+	}
+}
+
+// condition checks NZ, Z, NC, C, PO, PE, P and M
+func (cpu *Z80) condition(cc uint8) bool {
+	var mask uint8
+	switch cc >> 1 {
+	case 0:
+		mask = z80Z
+	case 1:
+		mask = z80C
+	case 2:
+		mask = z80PV
+	default:
+		mask = z80S
+	}
+	return (cpu.regs.f&mask != 0) == (cc&1 == 1)
+}
+
+func (cpu *Z80) execute() {
+	code := cpu.fetchOpcode()
+	switch code {
+	case 0xcb:
+		cpu.executeCB()
+	case 0xed:
+		cpu.executeED()
+	case 0xdd, 0xfd:
+		// prefix followed by another prefix acts as NOP
+		switch cpu.read(cpu.pc) {
+		case 0xdd, 0xed, 0xfd:
+			return
+		}
+		cpu.index = &cpu.ix
+		if code == 0xfd {
+			cpu.index = &cpu.iy
+		}
+		if cpu.read(cpu.pc) == 0xcb {
+			cpu.fetchOpcode()
+			cpu.executeIndexedCB()
+			return
+		}
+		cpu.executeMain(cpu.fetchOpcode())
+	default:
+		cpu.executeMain(code)
+	}
+}
+
+func (cpu *Z80) executeMain(code uint8) {
+	x, y, z := code>>6, code>>3&7, code&7
+	p, q := y>>1, y&1
+
+	if (x == 0 && z >= 4 && z <= 6 && y == 6) || (x == 1 && (y == 6) != (z == 6)) || (x == 2 && z == 6) {
+		cpu.addr = cpu.memOperand()
+	}
+
+	switch x {
+	case 0:
+		cpu.executeX0(y, z, p, q)
+	case 1:
+		if y == 6 && z == 6 {
+			cpu.halted = true
+			return
+		}
+		cpu.setReg(y, cpu.getReg(z))
+	case 2:
+		cpu.alu(y, cpu.getReg(z))
+	default:
+		cpu.executeX3(y, z, p, q)
+	}
+}
+
+func (cpu *Z80) executeX0(y, z, p, q uint8) {
+	switch z {
+	case 0:
+		switch y {
+		case 0:
+		case 1:
+			cpu.regs.a, cpu.alt.a = cpu.alt.a, cpu.regs.a
+			cpu.regs.f, cpu.alt.f = cpu.alt.f, cpu.regs.f
+		case 2:
+			disp := int8(cpu.fetch())
+			cpu.regs.b--
+			if cpu.regs.b != 0 {
+				cpu.pc += uint16(disp)
+			}
+		case 3:
+			disp := int8(cpu.fetch())
+			cpu.pc += uint16(disp)
+		default:
+			disp := int8(cpu.fetch())
+			if cpu.condition(y - 4) {
+				cpu.pc += uint16(disp)
+			}
+		}
+	case 1:
+		if q == 0 {
+			cpu.setPair(p, cpu.fetch16())
+		} else {
+			cpu.setHLX(cpu.add16(cpu.hlx(), cpu.getPair(p)))
+		}
+	case 2:
+		switch y {
+		case 0:
+			cpu.write(cpu.bc(), cpu.regs.a)
+		case 1:
+			cpu.regs.a = cpu.read(cpu.bc())
+		case 2:
+			cpu.write16(cpu.fetch16(), cpu.hlx())
+		case 3:
+			cpu.setHLX(cpu.read16(cpu.fetch16()))
+		case 4:
+			cpu.write(cpu.de(), cpu.regs.a)
+		case 5:
+			cpu.regs.a = cpu.read(cpu.de())
+		case 6:
+			cpu.write(cpu.fetch16(), cpu.regs.a)
+		default:
+			cpu.regs.a = cpu.read(cpu.fetch16())
+		}
+	case 3:
+		if q == 0 {
+			cpu.setPair(p, cpu.getPair(p)+1)
+		} else {
+			cpu.setPair(p, cpu.getPair(p)-1)
+		}
+	case 4:
+		cpu.setReg(y, cpu.inc8(cpu.getReg(y)))
+	case 5:
+		cpu.setReg(y, cpu.dec8(cpu.getReg(y)))
+	case 6:
+		cpu.setReg(y, cpu.fetch())
+	default:
+		cpu.executeAccumulatorOp(y)
+	}
+}
+
+// executeAccumulatorOp runs RLCA, RRCA, RLA, RRA, DAA, CPL, SCF and CCF
+func (cpu *Z80) executeAccumulatorOp(y uint8) {
+	a := cpu.regs.a
+	keep := cpu.regs.f & (z80S | z80Z | z80PV)
+
+	switch y {
+	case 0:
+		a = a<<1 | a>>7
+		cpu.regs.f = keep | a&(z80X|z80Y|z80C)
+	case 1:
+		carry := a & 1
+		a = a>>1 | a<<7
+		cpu.regs.f = keep | a&(z80X|z80Y) | carry
+	case 2:
+		carry := a >> 7
+		a = a<<1 | cpu.regs.f&z80C
+		cpu.regs.f = keep | a&(z80X|z80Y) | carry
+	case 3:
+		carry := a & 1
+		a = a>>1 | (cpu.regs.f&z80C)<<7
+		cpu.regs.f = keep | a&(z80X|z80Y) | carry
+	case 4:
+		cpu.daa()
+		return
+	case 5:
+		a = ^a
+		cpu.regs.f = cpu.regs.f&(z80S|z80Z|z80PV|z80C) | z80H | z80N | a&(z80X|z80Y)
+	case 6:
+		cpu.regs.f = keep | z80C | a&(z80X|z80Y)
+	default:
+		// H takes previous carry
+		carry := cpu.regs.f & z80C
+		cpu.regs.f = keep | carry<<4 | (carry ^ z80C) | a&(z80X|z80Y)
+	}
+	cpu.regs.a = a
+}
+
+func (cpu *Z80) executeX3(y, z, p, q uint8) {
+	switch z {
+	case 0:
+		if cpu.condition(y) {
+			cpu.pc = cpu.pop()
+		}
+	case 1:
+		if q == 0 {
+			cpu.setPair2(p, cpu.pop())
+			return
+		}
+		switch p {
+		case 0:
+			cpu.pc = cpu.pop()
+		case 1:
+			a, f := cpu.regs.a, cpu.regs.f
+			cpu.regs, cpu.alt = cpu.alt, cpu.regs
+			cpu.alt.a, cpu.alt.f = cpu.regs.a, cpu.regs.f
+			cpu.regs.a, cpu.regs.f = a, f
+		case 2:
+			cpu.pc = cpu.hlx()
+		default:
+			cpu.sp = cpu.hlx()
+		}
+	case 2:
+		addr := cpu.fetch16()
+		if cpu.condition(y) {
+			cpu.pc = addr
+		}
+	case 3:
+		switch y {
+		case 0:
+			cpu.pc = cpu.fetch16()
+		case 2:
+			cpu.out(cpu.fetch(), cpu.regs.a)
+		case 3:
+			cpu.regs.a = cpu.in(cpu.fetch())
+		case 4:
+			val := cpu.read16(cpu.sp)
+			cpu.write16(cpu.sp, cpu.hlx())
+			cpu.setHLX(val)
+		case 5:
+			de := cpu.de()
+			cpu.setDE(cpu.hl())
+			cpu.setHL(de)
+		case 6:
+			cpu.iff1, cpu.iff2 = false, false
+		case 7:
+			cpu.iff1, cpu.iff2 = true, true
+			cpu.eiDelay = true
+		}
+	case 4:
+		addr := cpu.fetch16()
+		if cpu.condition(y) {
+			cpu.push(cpu.pc)
+			cpu.pc = addr
+		}
+	case 5:
+		if q == 0 {
+			cpu.push(cpu.getPair2(p))
+			return
+		}
+		// p is 0 here, other values are prefixes
+		addr := cpu.fetch16()
+		if addr == decoder.BDOS {
+			cpu.bdos()
+			return
+		}
+		cpu.push(cpu.pc)
+		cpu.pc = addr
+	case 6:
+		cpu.alu(y, cpu.fetch())
+	default:
+		cpu.push(cpu.pc)
+		cpu.pc = uint16(y) * 8
+	}
+}
+
+func (cpu *Z80) executeCB() {
+	code := cpu.fetchOpcode()
+	x, y, z := code>>6, code>>3&7, code&7
+	cpu.addr = cpu.hl()
+
+	val := cpu.getReg(z)
+	switch x {
+	case 0:
+		cpu.setReg(z, cpu.rot(y, val))
+	case 1:
+		cpu.bit(y, val, val)
+	case 2:
+		cpu.setReg(z, val&^(1<<y))
+	default:
+		cpu.setReg(z, val|1<<y)
+	}
+}
+
+// executeIndexedCB runs DD CB d op and FD CB d op, result is also copied
+// to register unless it is (IX+d) form
+func (cpu *Z80) executeIndexedCB() {
+	addr := cpu.memOperand()
+	code := cpu.fetch()
+	x, y, z := code>>6, code>>3&7, code&7
+
+	val := cpu.read(addr)
+	var res uint8
+	switch x {
+	case 0:
+		res = cpu.rot(y, val)
+	case 1:
+		cpu.bit(y, val, uint8(addr>>8))
+		return
+	case 2:
+		res = val &^ (1 << y)
+	default:
+		res = val | 1<<y
+	}
+
+	cpu.write(addr, res)
+	if z != 6 {
+		cpu.setReg(z, res)
+	}
+}
+
+func (cpu *Z80) executeED() {
+	code := cpu.fetchOpcode()
+	x, y, z := code>>6, code>>3&7, code&7
+	p, q := y>>1, y&1
+	cpu.index = nil
+
+	if x == 2 && z <= 3 && y >= 4 {
+		cpu.block(y, z)
+		return
+	}
+	if x != 1 {
+		return
+	}
+
+	switch z {
+	case 0:
+		val := cpu.in(cpu.regs.c)
+		if y != 6 {
+			cpu.setReg(y, val)
+		}
+		cpu.regs.f = cpu.regs.f&z80C | sz53p(val)
+	case 1:
+		var val uint8
+		if y != 6 {
+			val = cpu.getReg(y)
+		}
+		cpu.out(cpu.regs.c, val)
+	case 2:
+		if q == 0 {
+			cpu.sbc16(cpu.getPair(p))
+		} else {
+			cpu.adc16(cpu.getPair(p))
+		}
+	case 3:
+		addr := cpu.fetch16()
+		if q == 0 {
+			cpu.write16(addr, cpu.getPair(p))
+		} else {
+			cpu.setPair(p, cpu.read16(addr))
+		}
+	case 4:
+		val := cpu.regs.a
+		cpu.regs.a = 0
+		cpu.alu(2, val)
+	case 5:
+		// RETN and RETI
+		cpu.pc = cpu.pop()
+		cpu.iff1 = cpu.iff2
+	case 6:
+		cpu.im = [8]uint8{0, 0, 1, 2, 0, 0, 1, 2}[y]
+	default:
+		cpu.executeEDMisc(y)
+	}
+}
+
+// executeEDMisc runs LD I,A, LD R,A, LD A,I, LD A,R, RRD and RLD
+func (cpu *Z80) executeEDMisc(y uint8) {
+	switch y {
+	case 0:
+		cpu.i = cpu.regs.a
+	case 1:
+		cpu.r = cpu.regs.a
+	case 2, 3:
+		cpu.regs.a = cpu.i
+		if y == 3 {
+			cpu.regs.a = cpu.r
+		}
+		cpu.regs.f = cpu.regs.f&z80C | sz53(cpu.regs.a)
+		if cpu.iff2 {
+			cpu.regs.f |= z80PV
+		}
+	case 4:
+		val := cpu.read(cpu.hl())
+		cpu.write(cpu.hl(), cpu.regs.a<<4|val>>4)
+		cpu.regs.a = cpu.regs.a&0xf0 | val&0x0f
+		cpu.regs.f = cpu.regs.f&z80C | sz53p(cpu.regs.a)
+	case 5:
+		val := cpu.read(cpu.hl())
+		cpu.write(cpu.hl(), val<<4|cpu.regs.a&0x0f)
+		cpu.regs.a = cpu.regs.a&0xf0 | val>>4
+		cpu.regs.f = cpu.regs.f&z80C | sz53p(cpu.regs.a)
+	}
+}
+
+// block runs LDI, CPI, INI, OUTI and their decrementing and repeating forms,
+// repeating instruction moves pc back to itself until it is done
+func (cpu *Z80) block(y, z uint8) {
+	step := uint16(1)
+	if y&1 == 1 {
+		step = 0xffff
+	}
+	repeat := y >= 6
+	again := false
+
+	switch z {
+	case 0:
+		val := cpu.read(cpu.hl())
+		cpu.write(cpu.de(), val)
+		cpu.setHL(cpu.hl() + step)
+		cpu.setDE(cpu.de() + step)
+		cpu.setBC(cpu.bc() - 1)
+
+		n := val + cpu.regs.a
+		cpu.regs.f = cpu.regs.f&(z80S|z80Z|z80C) | n&z80X | (n<<4)&z80Y
+		if cpu.bc() != 0 {
+			cpu.regs.f |= z80PV
+		}
+		again = cpu.bc() != 0
+	case 1:
+		val := cpu.read(cpu.hl())
+		res := cpu.regs.a - val
+		cpu.setHL(cpu.hl() + step)
+		cpu.setBC(cpu.bc() - 1)
+
+		f := cpu.regs.f&z80C | z80N | sz53(res)&(z80S|z80Z) | (cpu.regs.a^val^res)&z80H
+		n := res
+		if f&z80H != 0 {
+			n--
+		}
+		f |= n&z80X | (n<<4)&z80Y
+		if cpu.bc() != 0 {
+			f |= z80PV
+		}
+		cpu.regs.f = f
+		again = cpu.bc() != 0 && res != 0
+	case 2:
+		val := cpu.in(cpu.regs.c)
+		cpu.write(cpu.hl(), val)
+		cpu.setHL(cpu.hl() + step)
+		cpu.regs.b--
+		cpu.ioBlockFlags(val, int(val)+int(cpu.regs.c+uint8(step)))
+		again = cpu.regs.b != 0
+	default:
+		val := cpu.read(cpu.hl())
+		cpu.regs.b--
+		cpu.out(cpu.regs.c, val)
+		cpu.setHL(cpu.hl() + step)
+		cpu.ioBlockFlags(val, int(val)+int(cpu.regs.l))
+		again = cpu.regs.b != 0
+	}
+
+	if repeat && again {
+		cpu.pc -= 2
+	}
+}
+
+func (cpu *Z80) ioBlockFlags(val uint8, k int) {
+	f := sz53(cpu.regs.b)
+	if val&0x80 != 0 {
+		f |= z80N
+	}
+	if k > 0xff {
+		f |= z80H | z80C
+	}
+	f |= sz53p(uint8(k)&7^cpu.regs.b) & z80PV
+	cpu.regs.f = f
+}
+
+// bcd adjust after addition or subtraction
+func (cpu *Z80) daa() {
+	a := cpu.regs.a
+	f := cpu.regs.f
+
+	var diff, half uint8
+	carry := f & z80C
+	if f&z80H != 0 || a&0x0f > 9 {
+		diff = 0x06
+	}
+	if carry != 0 || a > 0x99 {
+		diff |= 0x60
+		carry = z80C
+	}
+
+	if f&z80N != 0 {
+		if f&z80H != 0 && a&0x0f < 6 {
+			half = z80H
+		}
+		a -= diff
+	} else {
+		if a&0x0f > 9 {
+			half = z80H
+		}
+		a += diff
+	}
+
+	cpu.regs.a = a
+	cpu.regs.f = sz53p(a) | carry | f&z80N | half
+}
+
+// alu runs ADD, ADC, SUB, SBC, AND, XOR, OR or CP with accumulator
+func (cpu *Z80) alu(op uint8, val uint8) {
+	a := cpu.regs.a
+	carry := uint16(cpu.regs.f & z80C)
+
+	switch op {
+	case 0, 1:
+		if op == 0 {
+			carry = 0
+		}
+		res := uint16(a) + uint16(val) + carry
+		f := sz53(uint8(res)) | uint8(res>>8)&z80C | (a^val^uint8(res))&z80H
+		if (a^val)&0x80 == 0 && (a^uint8(res))&0x80 != 0 {
+			f |= z80PV
+		}
+		cpu.regs.a = uint8(res)
+		cpu.regs.f = f
+	case 2, 3, 7:
+		if op != 3 {
+			carry = 0
+		}
+		res := uint16(a) - uint16(val) - carry
+		f := sz53(uint8(res)) | z80N | uint8(res>>8)&z80C | (a^val^uint8(res))&z80H
+		if (a^val)&(a^uint8(res))&0x80 != 0 {
+			f |= z80PV
+		}
+		if op == 7 {
+			// CP takes undocumented bits from operand
+			f = f&^(z80X|z80Y) | val&(z80X|z80Y)
+		} else {
+			cpu.regs.a = uint8(res)
+		}
+		cpu.regs.f = f
+	case 4:
+		cpu.regs.a &= val
+		cpu.regs.f = sz53p(cpu.regs.a) | z80H
+	case 5:
+		cpu.regs.a ^= val
+		cpu.regs.f = sz53p(cpu.regs.a)
+	default:
+		cpu.regs.a |= val
+		cpu.regs.f = sz53p(cpu.regs.a)
+	}
+}
+
+func (cpu *Z80) inc8(val uint8) uint8 {
+	res := val + 1
+	f := cpu.regs.f&z80C | sz53(res)
+	if val&0x0f == 0x0f {
+		f |= z80H
+	}
+	if val == 0x7f {
+		f |= z80PV
+	}
+	cpu.regs.f = f
+	return res
+}
+
+func (cpu *Z80) dec8(val uint8) uint8 {
+	res := val - 1
+	f := cpu.regs.f&z80C | z80N | sz53(res)
+	if val&0x0f == 0 {
+		f |= z80H
+	}
+	if val == 0x80 {
+		f |= z80PV
+	}
+	cpu.regs.f = f
+	return res
+}
+
+func (cpu *Z80) add16(x, y uint16) uint16 {
+	res := uint32(x) + uint32(y)
+	cpu.regs.f = cpu.regs.f&(z80S|z80Z|z80PV) | uint8(res>>16)&z80C |
+		uint8((uint32(x)^uint32(y)^res)>>8)&z80H | uint8(res>>8)&(z80X|z80Y)
+	return uint16(res)
+}
+
+func (cpu *Z80) adc16(y uint16) {
+	x := cpu.hl()
+	res := uint32(x) + uint32(y) + uint32(cpu.regs.f&z80C)
+	f := uint8(res>>16)&z80C | uint8((uint32(x)^uint32(y)^res)>>8)&z80H | uint8(res>>8)&(z80S|z80X|z80Y)
+	if uint16(res) == 0 {
+		f |= z80Z
+	}
+	if (x^y)&0x8000 == 0 && (x^uint16(res))&0x8000 != 0 {
+		f |= z80PV
+	}
+	cpu.regs.f = f
+	cpu.setHL(uint16(res))
+}
+
+func (cpu *Z80) sbc16(y uint16) {
+	x := cpu.hl()
+	res := uint32(x) - uint32(y) - uint32(cpu.regs.f&z80C)
+	f := z80N | uint8(res>>16)&z80C | uint8((uint32(x)^uint32(y)^res)>>8)&z80H | uint8(res>>8)&(z80S|z80X|z80Y)
+	if uint16(res) == 0 {
+		f |= z80Z
+	}
+	if (x^y)&(x^uint16(res))&0x8000 != 0 {
+		f |= z80PV
+	}
+	cpu.regs.f = f
+	cpu.setHL(uint16(res))
+}
+
+// rot runs RLC, RRC, RL, RR, SLA, SRA, SLL or SRL
+func (cpu *Z80) rot(op uint8, val uint8) uint8 {
+	var res, carry uint8
+	switch op {
+	case 0:
+		carry = val >> 7
+		res = val<<1 | carry
+	case 1:
+		carry = val & 1
+		res = val>>1 | carry<<7
+	case 2:
+		carry = val >> 7
+		res = val<<1 | cpu.regs.f&z80C
+	case 3:
+		carry = val & 1
+		res = val>>1 | (cpu.regs.f&z80C)<<7
+	case 4:
+		carry = val >> 7
+		res = val << 1
+	case 5:
+		carry = val & 1
+		res = val>>1 | val&0x80
+	case 6:
+		carry = val >> 7
+		res = val<<1 | 1
+	default:
+		carry = val & 1
+		res = val >> 1
+	}
+	cpu.regs.f = sz53p(res) | carry
+	return res
+}
+
+// bit tests bit n of val, undocumented X and Y flags come from xy
+func (cpu *Z80) bit(n uint8, val uint8, xy uint8) {
+	f := cpu.regs.f&z80C | z80H | xy&(z80X|z80Y)
+	if val&(1<<n) == 0 {
+		f |= z80Z | z80PV
+	} else if n == 7 {
+		f |= z80S
+	}
+	cpu.regs.f = f
+}
+
+func sz53(val uint8) uint8 {
+	f := val & (z80S | z80Y | z80X)
+	if val == 0 {
+		f |= z80Z
+	}
+	return f
+}
+
+func sz53p(val uint8) uint8 {
+	f := sz53(val)
+	if bits.OnesCount8(val)%2 == 0 {
+		f |= z80PV
+	}
+	return f
+}
+
+// bdos emulates CP/M console functions used by test programs
+func (cpu *Z80) bdos() {
+	switch cpu.regs.c {
+	case 0x0:
+		cpu.fault = &BDOSExitError{PC: cpu.opPC, Opcode: cpu.currentOp.Code}
+	case 0x2:
+		fmt.Printf("%c", cpu.regs.e)
+	case 0x9:
+		for addr := cpu.de(); cpu.read(addr) != '$'; addr++ {
+			fmt.Printf("%c", cpu.read(addr))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package machine
+
+import (
+	"errors"
+	"math/bits"
+	"testing"
+)
+
+// z80ALU is reference model of 8 bit ALU from Z80 user manual, bits 3 and 5 are copies
+// of result except for CP which takes them from operand
+func z80ALU(op, a, b, carry uint8) (uint8, uint8) {
+	if op != 1 && op != 3 {
+		carry = 0
+	}
+
+	var res, f uint8
+	switch op {
+	case 0, 1:
+		sum := int(a) + int(b) + int(carry)
+		res = uint8(sum)
+		signed := int(int8(a)) + int(int8(b)) + int(carry)
+		f = flagIf(int(a&0xf)+int(b&0xf)+int(carry) > 0xf, z80H) |
+			flagIf(signed < -128 || signed > 127, z80PV) |
+			flagIf(sum > 0xff, z80C)
+	case 2, 3, 7:
+		diff := int(a) - int(b) - int(carry)
+		res = uint8(diff)
+		signed := int(int8(a)) - int(int8(b)) - int(carry)
+		f = z80N | flagIf(int(a&0xf)-int(b&0xf)-int(carry) < 0, z80H) |
+			flagIf(signed < -128 || signed > 127, z80PV) |
+			flagIf(diff < 0, z80C)
+	case 4:
+		res = a & b
+		f = z80H | flagIf(bits.OnesCount8(res)%2 == 0, z80PV)
+	case 5:
+		res = a ^ b
+		f = flagIf(bits.OnesCount8(res)%2 == 0, z80PV)
+	case 6:
+		res = a | b
+		f = flagIf(bits.OnesCount8(res)%2 == 0, z80PV)
+	}
+
+	f |= res&z80S | flagIf(res == 0, z80Z)
+	if op == 7 {
+		return a, f | b&(z80X|z80Y)
+	}
+	return res, f | res&(z80X|z80Y)
+}
+
+func flagIf(cond bool, flag uint8) uint8 {
+	if cond {
+		return flag
+	}
+	return 0
+}
+
+func TestZ80ALU(t *testing.T) {
+	names := []string{"ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP"}
+	cpu := InitZ80()
+	for op := uint8(0); op < 8; op++ {
+		// op B
+		cpu.memory[0] = 0x80 | op<<3
+		for a := 0; a < 0x100; a++ {
+			for b := 0; b < 0x100; b++ {
+				for carry := uint8(0); carry < 2; carry++ {
+					cpu.pc = 0
+					cpu.regs.a, cpu.regs.b, cpu.regs.f = uint8(a), uint8(b), carry
+					if err := cpu.Step(); err != nil {
+						t.Fatal(err)
+					}
+					wantA, wantF := z80ALU(op, uint8(a), uint8(b), carry)
+					if cpu.regs.a != wantA || cpu.regs.f != wantF {
+						t.Fatalf("%s a=%02x b=%02x cy=%d: got a=%02x f=%02x, want a=%02x f=%02x",
+							names[op], a, b, carry, cpu.regs.a, cpu.regs.f, wantA, wantF)
+					}
+				}
+			}
+		}
+	}
+}
+
+// portLog records OUT writes
+type portLog map[uint8]uint8
+
+func (p portLog) In(port uint8) uint8 { return p[port] }
+func (p portLog) Out(port, val uint8) { p[port] = val }
+
+func TestZ80Instructions(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []byte
+		setup   func(cpu *Z80)
+		check   func(cpu *Z80) bool
+	}{
+		{
+			name:    "LD r,n and LD r,r",
+			program: []byte{0x06, 0x12, 0x48},
+			check:   func(cpu *Z80) bool { return cpu.regs.b == 0x12 && cpu.regs.c == 0x12 },
+		},
+		{
+			name:    "LD (IX+d),n and LD A,(IX+d)",
+			program: []byte{0xdd, 0x21, 0x00, 0x10, 0xdd, 0x36, 0x05, 0xaa, 0xdd, 0x7e, 0x05},
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 0xaa && cpu.memory[0x1005] == 0xaa },
+		},
+		{
+			name:    "DJNZ loop",
+			program: []byte{0x06, 0x05, 0xaf, 0x3c, 0x10, 0xfd},
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 5 && cpu.regs.b == 0 },
+		},
+		{
+			name:    "JR NZ not taken",
+			program: []byte{0xaf, 0x20, 0x02, 0x3e, 0x01},
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 1 },
+		},
+		{
+			name:    "CALL and RET",
+			program: []byte{0x31, 0x00, 0x20, 0xcd, 0x0a, 0x00, 0x76, 0x00, 0x00, 0x00, 0x3e, 0x42, 0xc9},
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 0x42 && cpu.sp == 0x2000 },
+		},
+		{
+			name:    "PUSH AF and POP BC",
+			program: []byte{0x31, 0x00, 0x20, 0x3e, 0x80, 0xb7, 0xf5, 0xc1},
+			check:   func(cpu *Z80) bool { return cpu.regs.b == 0x80 && cpu.regs.c == z80S },
+		},
+		{
+			name:    "EX AF,AF' and EXX",
+			program: []byte{0x3e, 0x11, 0x08, 0x3e, 0x22, 0x08, 0x01, 0x34, 0x12, 0xd9, 0x01, 0x00, 0x00, 0xd9},
+			check: func(cpu *Z80) bool {
+				return cpu.regs.a == 0x11 && cpu.alt.a == 0x22 && cpu.bc() == 0x1234 && cpu.alt.b == 0 && cpu.alt.c == 0
+			},
+		},
+		{
+			name:    "LDIR",
+			program: []byte{0x21, 0x00, 0x10, 0x11, 0x00, 0x11, 0x01, 0x03, 0x00, 0xed, 0xb0},
+			setup:   func(cpu *Z80) { copy(cpu.memory[0x1000:], []byte{1, 2, 3}) },
+			check: func(cpu *Z80) bool {
+				return cpu.memory[0x1100] == 1 && cpu.memory[0x1102] == 3 && cpu.bc() == 0 &&
+					cpu.hl() == 0x1003 && cpu.de() == 0x1103 && cpu.regs.f&z80PV == 0
+			},
+		},
+		{
+			name:    "NEG",
+			program: []byte{0x3e, 0x01, 0xed, 0x44},
+			check: func(cpu *Z80) bool {
+				return cpu.regs.a == 0xff && cpu.regs.f == z80S|z80Y|z80H|z80X|z80N|z80C
+			},
+		},
+		{
+			name:    "CB rotate, SET, RES and BIT",
+			program: []byte{0x06, 0x80, 0xcb, 0x00, 0xcb, 0xf8, 0xcb, 0x80, 0xcb, 0x78},
+			check: func(cpu *Z80) bool {
+				return cpu.regs.b == 0x80 && cpu.regs.f&z80Z == 0 && cpu.regs.f&z80C != 0
+			},
+		},
+		{
+			name:    "DAA after ADD",
+			program: []byte{0x3e, 0x15, 0xc6, 0x27, 0x27},
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 0x42 && cpu.regs.f&z80C == 0 },
+		},
+		{
+			name:    "DAA after SUB",
+			program: []byte{0x3e, 0x42, 0xd6, 0x15, 0x27},
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 0x27 && cpu.regs.f&z80N != 0 },
+		},
+		{
+			name:    "ADD HL,DE carry",
+			program: []byte{0x21, 0xff, 0xff, 0x11, 0x01, 0x00, 0x19},
+			check:   func(cpu *Z80) bool { return cpu.hl() == 0 && cpu.regs.f&z80C != 0 },
+		},
+		{
+			name:    "SBC HL,DE",
+			program: []byte{0x21, 0x00, 0x10, 0x11, 0x01, 0x00, 0x37, 0xed, 0x52},
+			check:   func(cpu *Z80) bool { return cpu.hl() == 0x0ffe && cpu.regs.f&z80N != 0 },
+		},
+		{
+			name:    "RLD",
+			program: []byte{0x21, 0x00, 0x10, 0x3e, 0x12, 0xed, 0x6f},
+			setup:   func(cpu *Z80) { cpu.memory[0x1000] = 0x34 },
+			check:   func(cpu *Z80) bool { return cpu.regs.a == 0x13 && cpu.memory[0x1000] == 0x42 },
+		},
+		{
+			name:    "OUT (n),A and IN A,(n)",
+			program: []byte{0x3e, 0x55, 0xd3, 0x07, 0xdb, 0x08},
+			setup:   func(cpu *Z80) { cpu.IO = portLog{0x08: 0x99} },
+			check: func(cpu *Z80) bool {
+				return cpu.IO.(portLog)[0x07] == 0x55 && cpu.regs.a == 0x99
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := InitZ80()
+			copy(cpu.memory[:], append(tt.program, 0x76))
+			if tt.setup != nil {
+				tt.setup(cpu)
+			}
+			runUntilHalt(t, cpu)
+			if !tt.check(cpu) {
+				t.Errorf("unexpected state %v", cpu.Registers())
+			}
+		})
+	}
+}
+
+func runUntilHalt(t *testing.T, cpu *Z80) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		err := cpu.Step()
+		if errors.As(err, new(*HaltedError)) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("program did not halt")
+}
+
+func TestZ80InterruptIsLatched(t *testing.T) {
+	cpu := InitZ80()
+	// DI, EI, NOP, NOP
+	copy(cpu.memory[:], []byte{0xf3, 0xfb, 0x00, 0x00})
+	cpu.sp = 0x2000
+
+	cpu.Step()
+	cpu.GenerateInterrupt(1)
+	// EI and the following instruction run before request is accepted
+	cpu.Step()
+	cpu.Step()
+	if cpu.pc != 3 {
+		t.Fatalf("interrupt accepted too early, pc %04x", cpu.pc)
+	}
+	cpu.Step()
+	if cpu.pc != 0x08 || cpu.read16(cpu.sp) != 3 {
+		t.Fatalf("RST 1 expected, pc %04x return %04x", cpu.pc, cpu.read16(cpu.sp))
+	}
+	if cpu.iff1 || cpu.irq {
+		t.Fatal("interrupts must be disabled and request cleared")
+	}
+}
+
+func TestZ80InterruptModes(t *testing.T) {
+	t.Run("IM 2 reads vector table", func(t *testing.T) {
+		cpu := InitZ80()
+		// LD A,0x10; LD I,A; IM 2; EI; NOP
+		copy(cpu.memory[:], []byte{0x3e, 0x10, 0xed, 0x47, 0xed, 0x5e, 0xfb, 0x00})
+		cpu.memory[0x10cf], cpu.memory[0x10d0] = 0x34, 0x12
+		for i := 0; i < 5; i++ {
+			cpu.Step()
+		}
+		cpu.GenerateInterrupt(1)
+		cpu.Step()
+		if cpu.pc != 0x1234 {
+			t.Fatalf("pc %04x, want 1234", cpu.pc)
+		}
+	})
+
+	t.Run("IM 1 wakes HALT", func(t *testing.T) {
+		cpu := InitZ80()
+		// IM 1; EI; HALT
+		copy(cpu.memory[:], []byte{0xed, 0x56, 0xfb, 0x76})
+		cpu.sp = 0x2000
+		cpu.Step()
+		cpu.Step()
+		cpu.Step()
+		if !cpu.IsHalted() {
+			t.Fatal("cpu should be halted")
+		}
+		cpu.GenerateInterrupt(1)
+		cpu.Step()
+		if cpu.IsHalted() || cpu.pc != 0x38 || cpu.read16(cpu.sp) != 4 {
+			t.Fatalf("pc %04x return %04x halted %t", cpu.pc, cpu.read16(cpu.sp), cpu.IsHalted())
+		}
+	})
+}
@@ -1,66 +1,256 @@
 package main
 
 import (
+	"cpu-emulator/decoder"
 	"cpu-emulator/machine"
 	spacegameMachine "cpu-emulator/space-invaders"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 const defaultPath string = "./roms/space-invaders.rom"
 
+var (
+	romPath string
+
+	debugFlag       bool
+	remoteDebugFlag bool
+	tuiFlag         bool
+	dapFlag         bool
+	memViewFlag     bool
+
+	watchdogLog     bool
+	noWatchdogReset bool
+
+	listingPath string
+	profilePath string
+	cpuModel    string
+	ioTracePath string
+	overlayName string
+
+	backgroundPath string
+	bezelPath      string
+	screenRect     string
+	blendMode      string
+	scaleMode      string
+	filterName     string
+	fullscreen     bool
+	persistence    int
+	cocktail       bool
+	rotation       int
+
+	screenshotFrame uint64
+	screenshotRaw   bool
+	recordPath      string
+	recordFrames    uint64
+	recordRaw       bool
+	recordAudio     string
+	showStats       bool
+)
+
 func main() {
 	setFlags()
-	var buffer []byte
+	model, err := decoder.ParseCPUModel(cpuModel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if model == decoder.Z80 {
+		runZ80()
+		return
+	}
+
 	cpu := machine.InitCpu()
+	cpu.Model = model
+	romHash := loadRom(cpu)
 
-	args := os.Args[1:]
+	var profiler *machine.Profiler
+	if profilePath != "" {
+		profiler = machine.NewProfiler()
+		cpu.Profiler = profiler
+	}
 
-	if len(args) > 1 {
-		flag := os.Args[3]
-		fileBuffer, err := os.ReadFile(args[1])
-		buffer = fileBuffer
+	if memViewFlag {
+		viewer := machine.NewMemoryViewer(cpu, os.Stdout)
+		viewer.Labels = spacegameMachine.MemoryLabels
+		go viewer.Run(16 * time.Millisecond)
+	}
+
+	bus := machine.NewBus()
+	if ioTracePath != "" {
+		f, err := os.Create(ioTracePath)
 		if err != nil {
-			log.Panic(err)
+			log.Fatal(err)
 		}
+		defer f.Close()
+		bus.TraceTo(f)
+	}
 
-		if flag == "-rd" || flag == "-d" {
-			dbg := machine.InitDebugger(flag)
-			dbg.Debug(cpu)
-			return
+	overlay, err := spacegameMachine.FindOverlay(overlayName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := spacegameMachine.Options{
+		WatchdogLog:     watchdogLog,
+		NoWatchdogReset: noWatchdogReset,
+		Overlay:         overlay,
+		Background:      backgroundPath,
+		Bezel:           bezelPath,
+		BlendMode:       blendMode,
+		ScaleMode:       scaleMode,
+		Filter:          filterName,
+		Fullscreen:      fullscreen,
+		Persistence:     persistence,
+		Cocktail:        cocktail,
+		Rotation:        rotation,
+		ROMHash:         romHash,
+		Record:          recordPath,
+		RecordRaw:       recordRaw,
+		RecordAudio:     recordAudio,
+		ScreenshotRaw:   screenshotRaw,
+		ShowStats:       showStats,
+	}
+	if screenRect != "" {
+		if opts.ScreenRect, err = spacegameMachine.ParseRect(screenRect); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-	} else {
-		fileBuffer, err := os.ReadFile(defaultPath)
-		if err != nil {
-			log.Panic(err)
+	if recordFrames > 0 && recordPath == "" && recordAudio == "" {
+		log.Fatal("-record-frames requires -record or -record-audio")
+	}
+	switch {
+	case tuiFlag:
+		tui := machine.InitTUI(cpu, os.Stdout)
+		tui.ROMHash = romHash
+		tui.Step = spacegameMachine.Attach(cpu, bus, opts)
+		tui.Run()
+	case debugFlag:
+		dbg := machine.InitDebugger()
+		dbg.Step = spacegameMachine.Attach(cpu, bus, opts)
+		dbg.Debug(cpu)
+	case dapFlag:
+		var listing *machine.Listing
+		if listingPath != "" {
+			listing, err = machine.LoadListing(listingPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		srv := machine.NewDAPServer(cpu, listing)
+		srv.Step = spacegameMachine.Attach(cpu, bus, opts)
+		log.Fatal(srv.ListenAndServe(machine.DefaultDAPAddr))
+	case remoteDebugFlag:
+		srv := machine.NewDebugServer(cpu)
+		srv.Step = spacegameMachine.Attach(cpu, bus, opts)
+		log.Fatal(srv.ListenAndServe(machine.DefaultDebugServerAddr))
+	case screenshotFrame > 0 || recordFrames > 0:
+		frames := max(screenshotFrame, recordFrames)
+		if err := spacegameMachine.Headless(cpu, bus, opts, frames, screenshotFrame); err != nil {
+			log.Fatal(err)
 		}
-		buffer = fileBuffer
+	default:
+		spacegameMachine.Main(cpu, bus, opts)
 	}
 
+	if profiler != nil {
+		writeProfile(profiler, cpu)
+	}
+}
+
+// loadRom reads ROM given by -r or the default one into any cpu core and returns its SHA-256
+func loadRom(cpu machine.Processor) string {
+	path := defaultPath
+	if romPath != "" {
+		path = romPath
+	}
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
 	cpu.LoadRom(buffer)
+	return fmt.Sprintf("%x", sha256.Sum256(buffer))
+}
 
-	spacegameMachine.Main(cpu)
+// runZ80 runs ROM on Z80 core, without debugger it runs until HALT or CP/M exit
+func runZ80() {
+	cpu := machine.InitZ80()
+	romHash := loadRom(cpu)
+
+	switch {
+	case tuiFlag:
+		tui := machine.InitTUI(cpu, os.Stdout)
+		tui.ROMHash = romHash
+		tui.Run()
+	case debugFlag:
+		machine.InitDebugger().Debug(cpu)
+	case remoteDebugFlag, dapFlag, memViewFlag, profilePath != "":
+		log.Fatal("z80 core supports only -d and -t")
+	default:
+		if err := cpu.Run(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func writeProfile(profiler *machine.Profiler, cpu *machine.Cpu) {
+	f, err := os.Create(profilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	profiler.WriteReport(f, cpu)
 }
 
 func setFlags() {
-	usageText := "Usage: go run . -r <path> (-rd | -r)"
+	usageText := "Usage: go run . [-r <path>] [-rd | -d | -t | -dap [-l <listing>]]"
 
-	rFlag := flag.String("r", "", "path to the ROM file")
-	drFlag := flag.Bool("rd", true, "debug with remote debugger")
-	dFlag := flag.Bool("d", true, "default debug")
-	pFlag := flag.Bool("p", true, "play space invaders")
+	flag.StringVar(&romPath, "r", "", "path to the ROM file")
+	flag.BoolVar(&remoteDebugFlag, "rd", false, "run JSON debug server on "+machine.DefaultDebugServerAddr)
+	flag.BoolVar(&debugFlag, "d", false, "default debug")
+	flag.BoolVar(&tuiFlag, "t", false, "full screen terminal debugger")
+	flag.BoolVar(&dapFlag, "dap", false, "run Debug Adapter Protocol server on "+machine.DefaultDAPAddr)
+	flag.StringVar(&listingPath, "l", "", "assembler listing file for DAP source mapping")
+	flag.Bool("p", true, "play space invaders")
+	flag.StringVar(&cpuModel, "cpu", "8080", "cpu model: 8080 (with undocumented opcodes), 8085 or z80")
+	flag.StringVar(&profilePath, "prof", "", "write coverage and hot spot report to file on exit")
+	flag.BoolVar(&memViewFlag, "m", false, "show live memory viewer in terminal")
+	flag.StringVar(&ioTracePath, "iotrace", "", "write every IN and OUT port access to file")
+	flag.BoolVar(&watchdogLog, "watchdog-log", false, "log every watchdog kick on port 6")
+	flag.StringVar(&overlayName, "overlay", "upright", "color overlay: upright, japanese, mono or path to overlay file")
+	flag.StringVar(&backgroundPath, "background", "", "PNG cabinet backdrop drawn under the screen")
+	flag.StringVar(&bezelPath, "bezel", "", "PNG bezel with transparent window drawn over the screen")
+	flag.StringVar(&screenRect, "screen-rect", "", "screen placement in window as x,y,w,h")
+	flag.StringVar(&blendMode, "blend", "add", "how screen is drawn over background: add, blend or none")
+	flag.StringVar(&scaleMode, "scale", "aspect", "screen scaling: aspect, integer or stretch")
+	flag.StringVar(&filterName, "filter", "nearest", "video filter: nearest, scanlines, scale2x or glow")
+	flag.BoolVar(&fullscreen, "fullscreen", false, "start in fullscreen")
+	flag.IntVar(&persistence, "persistence", 0, "number of frames lit pixels take to fade out, 0 turns it off")
+	flag.BoolVar(&cocktail, "cocktail", false, "cocktail cabinet: player 2 controls and screen flip")
+	flag.IntVar(&rotation, "rotate", 0, "rotate screen clockwise by 0, 90, 180 or 270 degrees")
+	flag.Uint64Var(&screenshotFrame, "screenshot-at-frame", 0, "run without window and save screenshot of frame N")
+	flag.BoolVar(&screenshotRaw, "screenshot-raw", false, "save raw 1-bit VRAM instead of frame with overlay")
+	flag.StringVar(&recordPath, "record", "", "record every frame to .gif or .y4m file")
+	flag.Uint64Var(&recordFrames, "record-frames", 0, "run without window and record N frames to -record and -record-audio files")
+	flag.StringVar(&recordAudio, "record-audio", "", "record sound to .wav file")
+	flag.BoolVar(&recordRaw, "record-raw", false, "record raw 1-bit VRAM instead of overlay colors")
+	flag.BoolVar(&showStats, "fps", false, "show FPS, emulation speed and cycles per frame on screen")
+	flag.BoolVar(&noWatchdogReset, "no-watchdog", false, "don't reset the game when watchdog expires, only log it")
 	flag.Parse()
 
-	if *pFlag {
-		if *rFlag != "" {
-			fmt.Println(usageText)
-			os.Exit(1)
-		} else if !*drFlag && !*dFlag {
-			fmt.Println(usageText)
-			os.Exit(1)
+	modes := 0
+	for _, mode := range []bool{debugFlag, remoteDebugFlag, tuiFlag, dapFlag} {
+		if mode {
+			modes++
 		}
 	}
+
+	if modes > 1 || (modes == 1 && romPath == "") {
+		fmt.Println(usageText)
+		os.Exit(1)
+	}
 }
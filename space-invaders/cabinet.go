@@ -0,0 +1,140 @@
+package spacegameMachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// cabinet is artwork composited around emulated screen
+type cabinet struct {
+	// background is drawn first, screen is blended over it and bezel covers both
+	background *sdl.Texture
+	bezel      *sdl.Texture
+	// screen is placement of emulated screen in window set by user, nil means it depends on scale mode
+	screen *sdl.Rect
+	blend  sdl.BlendMode
+}
+
+// BlendModes are ways emulated screen is blended over background
+var BlendModes = map[string]sdl.BlendMode{
+	// add is reflection of the monitor in glass as in the cabinet, black is transparent
+	"add": sdl.BLENDMODE_ADD,
+	// blend draws lit pixels opaque, unlit ones are transparent
+	"blend": sdl.BLENDMODE_BLEND,
+	// none draws whole screen opaque, background is seen only outside of it
+	"none": sdl.BLENDMODE_NONE,
+}
+
+// ParseRect parses placement "x,y,w,h" in window pixels
+func ParseRect(s string) (*sdl.Rect, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("rect %q must be x,y,w,h", s)
+	}
+	var values [4]int32
+	for i, part := range parts {
+		v, err := strconv.ParseInt(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("rect %q: %w", s, err)
+		}
+		values[i] = int32(v)
+	}
+	if values[2] <= 0 || values[3] <= 0 {
+		return nil, fmt.Errorf("rect %q must have positive size", s)
+	}
+	return &sdl.Rect{X: values[0], Y: values[1], W: values[2], H: values[3]}, nil
+}
+
+func newCabinet(renderer *sdl.Renderer, opts Options) (*cabinet, error) {
+	cab := &cabinet{screen: opts.ScreenRect, blend: sdl.BLENDMODE_ADD}
+	if opts.BlendMode != "" {
+		mode, ok := BlendModes[opts.BlendMode]
+		if !ok {
+			return nil, fmt.Errorf("unknown blend mode %q", opts.BlendMode)
+		}
+		cab.blend = mode
+	}
+
+	var err error
+	if opts.Background != "" {
+		if cab.background, err = loadTexture(renderer, opts.Background); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Bezel != "" {
+		if cab.bezel, err = loadTexture(renderer, opts.Bezel); err != nil {
+			// background is already loaded, nobody else would destroy it
+			cab.destroy()
+			return nil, err
+		}
+		cab.bezel.SetBlendMode(sdl.BLENDMODE_BLEND)
+	}
+	return cab, nil
+}
+
+// hasArtwork reports whether screen is composited with background or bezel
+func (cab *cabinet) hasArtwork() bool {
+	return cab.background != nil || cab.bezel != nil
+}
+
+// draw draws screen texture at placement rotated by angle around its center between background and bezel
+func (cab *cabinet) draw(renderer *sdl.Renderer, screen *sdl.Texture, placement *sdl.Rect, angle float64) {
+	if cab.background != nil {
+		renderer.Copy(cab.background, nil, nil)
+	}
+	renderer.CopyEx(screen, nil, placement, angle, nil, sdl.FLIP_NONE)
+	if cab.bezel != nil {
+		renderer.Copy(cab.bezel, nil, nil)
+	}
+}
+
+func (cab *cabinet) destroy() {
+	for _, texture := range []*sdl.Texture{cab.background, cab.bezel} {
+		if texture != nil {
+			texture.Destroy()
+		}
+	}
+}
+
+// loadTexture decodes PNG image into static texture, alpha channel is kept
+func loadTexture(renderer *sdl.Renderer, path string) (*sdl.Texture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	bounds := img.Bounds()
+	texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_RGBA8888, sdl.TEXTUREACCESS_STREAMING, int32(bounds.Dx()), int32(bounds.Dy()))
+	if err != nil {
+		return nil, err
+	}
+
+	pixels, pitch, err := texture.Lock(nil)
+	if err != nil {
+		texture.Destroy()
+		return nil, err
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		row := pixels[y*pitch:]
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			rgba := uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+			binary.NativeEndian.PutUint32(row[x*4:], rgba)
+		}
+	}
+	texture.Unlock()
+	return texture, nil
+}
@@ -0,0 +1,69 @@
+package spacegameMachine
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// player2Controls are bits of shot, left and right in port 2
+const player2Controls = 0x70
+
+// inputs are cabinet input ports 0-2: buttons, coin slot and DIP switches.
+// Upright cabinet has single control panel wired to both players, cocktail one has
+// panel for player 2 on the other side
+type inputs struct {
+	ports    [3]uint8
+	cocktail bool
+}
+
+func newInputs(cocktail bool) *inputs {
+	return &inputs{ports: [3]uint8{0b00001110, 0x8, 0}, cocktail: cocktail}
+}
+
+func (in *inputs) In(port uint8) uint8 {
+	if port == 2 && !in.cocktail {
+		return in.ports[2]&^player2Controls | in.ports[1]&player2Controls
+	}
+	return in.ports[port]
+}
+
+func (in *inputs) Out(port uint8, val uint8) {}
+
+// flipLatch keeps flip screen bit 5 of port 5, cocktail cabinet flips screen while player 2 plays
+type flipLatch struct {
+	flipped atomic.Bool
+}
+
+func (f *flipLatch) In(port uint8) uint8 {
+	return 0
+}
+
+func (f *flipLatch) Out(port uint8, val uint8) {
+	f.flipped.Store(val&0x20 != 0)
+}
+
+// watchdogFrames is timeout of the board watchdog, it resets cpu unless port 6 is written in time
+const watchdogFrames = 255
+
+// watchdog counts frames since the last write to port 6
+type watchdog struct {
+	frames  int
+	logKick bool
+}
+
+func (w *watchdog) In(port uint8) uint8 {
+	return 0
+}
+
+func (w *watchdog) Out(port uint8, val uint8) {
+	if w.logKick {
+		log.Printf("watchdog kick 0x%02x after %d frames", val, w.frames)
+	}
+	w.frames = 0
+}
+
+// frame counts one frame and reports whether timeout expired just now
+func (w *watchdog) frame() bool {
+	w.frames++
+	return w.frames == watchdogFrames
+}
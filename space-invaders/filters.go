@@ -0,0 +1,102 @@
+package spacegameMachine
+
+// Filter post-processes rendered frame on cpu, output is Scale times bigger in both directions
+type Filter struct {
+	Name  string
+	Scale int
+	apply func(dst, src []uint32, w, h int)
+}
+
+// Filters are selectable by -filter and cycled with F10
+var Filters = []*Filter{
+	{Name: "nearest", Scale: 1, apply: func(dst, src []uint32, w, h int) { copy(dst, src) }},
+	{Name: "scanlines", Scale: 2, apply: scanlines},
+	{Name: "scale2x", Scale: 2, apply: scale2x},
+	{Name: "glow", Scale: 1, apply: glow},
+}
+
+// dim halves color channels and keeps alpha
+func dim(c uint32) uint32 {
+	return (c>>1)&0x7F7F7F00 | c&0xFF
+}
+
+// addColors adds colors by channels, saturating at 0xFF
+func addColors(a, b uint32) uint32 {
+	var res uint32
+	for shift := 0; shift < 32; shift += 8 {
+		sum := (a>>shift)&0xFF + (b>>shift)&0xFF
+		res |= min(sum, 0xFF) << shift
+	}
+	return res
+}
+
+// scanlines doubles pixels and darkens every second row like gaps between CRT lines
+func scanlines(dst, src []uint32, w, h int) {
+	for y := 0; y < h; y++ {
+		line := dst[2*y*2*w:]
+		gap := dst[(2*y+1)*2*w:]
+		for x := 0; x < w; x++ {
+			c := src[y*w+x]
+			line[2*x], line[2*x+1] = c, c
+			gap[2*x], gap[2*x+1] = dim(c), dim(c)
+		}
+	}
+}
+
+// scale2x is EPX pixel art scaler, it rounds diagonal edges without blurring
+func scale2x(dst, src []uint32, w, h int) {
+	at := func(x, y int) uint32 {
+		x = max(0, min(x, w-1))
+		y = max(0, min(y, h-1))
+		return src[y*w+x]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := at(x, y)
+			a, b, c, d := at(x, y-1), at(x+1, y), at(x-1, y), at(x, y+1)
+			e0, e1, e2, e3 := p, p, p, p
+			if c == a && c != d && a != b {
+				e0 = a
+			}
+			if a == b && a != c && b != d {
+				e1 = b
+			}
+			if d == c && d != b && c != a {
+				e2 = c
+			}
+			if b == d && b != a && d != c {
+				e3 = d
+			}
+			top := dst[2*y*2*w:]
+			bottom := dst[(2*y+1)*2*w:]
+			top[2*x], top[2*x+1] = e0, e1
+			bottom[2*x], bottom[2*x+1] = e2, e3
+		}
+	}
+}
+
+// glow bleeds quarter of every lit neighbour into pixel like light scattered in CRT glass
+func glow(dst, src []uint32, w, h int) {
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := src[y*w+x]
+			if x > 0 {
+				c = addColors(c, quarter(src[y*w+x-1]))
+			}
+			if x < w-1 {
+				c = addColors(c, quarter(src[y*w+x+1]))
+			}
+			if y > 0 {
+				c = addColors(c, quarter(src[(y-1)*w+x]))
+			}
+			if y < h-1 {
+				c = addColors(c, quarter(src[(y+1)*w+x]))
+			}
+			dst[y*w+x] = c
+		}
+	}
+}
+
+func quarter(c uint32) uint32 {
+	return (c >> 2) & 0x3F3F3F3F
+}
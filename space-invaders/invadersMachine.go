@@ -2,9 +2,14 @@ package spacegameMachine
 
 import (
 	"cpu-emulator/machine"
+	"errors"
 	"fmt"
 	"log"
+	"math/bits"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/veandco/go-sdl2/sdl"
@@ -16,8 +21,17 @@ const (
 	right      = sdl.K_d
 	insertCoin = sdl.K_s
 	start      = sdl.K_w
+	start2     = sdl.K_2
+
+	// player 2 panel of cocktail cabinet
+	fire2  = sdl.K_k
+	left2  = sdl.K_j
+	right2 = sdl.K_l
 )
 
+// player2Keys maps keys of player 2 panel to the same controls of player 1 which are on the same bits
+var player2Keys = map[sdl.Keycode]sdl.Keycode{fire2: fire, left2: left, right2: right}
+
 const (
 	RGB_ON  uint32 = 0xFFFFFFFF
 	RGB_OFF uint32 = 0x000000FF
@@ -27,33 +41,120 @@ const (
 	height = 256
 )
 
+// MemoryLabels are well known work RAM locations for memory viewer
+var MemoryLabels = map[string]uint16{
+	"credits":  0x20EB,
+	"score1lo": 0x20F8,
+	"score1hi": 0x20F9,
+	"score2lo": 0x20FC,
+	"score2hi": 0x20FD,
+	"lives1":   0x21FF,
+	"lives2":   0x22FF,
+}
+
+// Options configure emulated board
+type Options struct {
+	// WatchdogLog logs every write to watchdog port
+	WatchdogLog bool
+	// NoWatchdogReset only logs expired watchdog instead of resetting cpu
+	NoWatchdogReset bool
+	// Overlay is initial color overlay, nil means upright cabinet
+	Overlay *Overlay
+
+	// Background and Bezel are PNG files of cabinet artwork drawn under and over the screen
+	Background string
+	Bezel      string
+	// ScreenRect places screen in window, by default placement depends on ScaleMode
+	ScreenRect *sdl.Rect
+	// BlendMode is one of BlendModes used to draw screen over background, add by default
+	BlendMode string
+
+	// ScaleMode is one of ScaleModes and Filter is name of one of Filters, both can be changed while playing
+	ScaleMode  string
+	Filter     string
+	Fullscreen bool
+
+	// Persistence is number of frames lit pixels take to fade out, 0 turns pixels off instantly
+	Persistence int
+
+	// Cocktail wires player 2 panel and flips screen while player 2 plays
+	Cocktail bool
+	// Rotation rotates screen clockwise by 0, 90, 180 or 270 degrees for rotated monitors
+	Rotation int
+
+	// Record is .gif or .y4m file recorded from start, RecordRaw records 1-bit VRAM instead of overlay colors
+	Record    string
+	RecordRaw bool
+	// RecordAudio is WAV file recorded from start
+	RecordAudio string
+	// ScreenshotRaw makes screenshot of Headless raw 1-bit VRAM
+	ScreenshotRaw bool
+
+	// ShowStats shows FPS, emulation speed and cycles per frame on screen
+	ShowStats bool
+
+	// ROMHash is SHA-256 of the ROM stored in screenshots
+	ROMHash string
+
+	// FrameReady is called from emulation goroutine at every VBlank with complete frame,
+	// frame is reused after it returns
+	FrameReady func(frame *Frame)
+}
+
 type spaceInvadersMachine struct {
-	cpu *machine.Cpu
+	cpu      *machine.Cpu
+	inputs   *inputs
+	shift    *machine.ShiftRegister
+	flip     *flipLatch
+	sound    *sound
+	watchdog *watchdog
+	opts     Options
 
 	bitmap []byte
-
-	cyclesRan          uint64
-	lastInterruptCycle uint64
-	whichInterrupt     int
+	// offColor is color of unlit pixel, transparent when screen is blended over artwork
+	offColor uint32
+	// overlays can be cycled while game runs, overlay is index of the current one
+	overlays []*Overlay
+	overlay  atomic.Int32
+	// persistence is nil when pixels turn off instantly
+	persistence *persistence
+	// refreshes counts mid-screen and VBlank interrupts, beam refreshed part of screen before each
+	refreshes [2]atomic.Uint64
+
+	cyclesRan atomic.Uint64
+	raster    *raster
+	// vram is frame copied from raster for rendering, frame is its number
+	vram  []byte
+	frame uint64
+	// screenshot is requested by hotkey and saved by render loop
+	screenshot atomic.Int32
+	// recorder is set while frames are recorded
+	recorder   *recorder
+	recordLock sync.Mutex
+
+	video *video
+	osd   *osd
 
 	pause     uint8
 	syncPause *sync.WaitGroup
+	// stop ends internalUpdate, stopped is closed when it returned
+	stop    atomic.Bool
+	stopped chan struct{}
 }
 
-type gameIO struct {
-	shift0      uint8 //LSB of Space Invader's external shift hardware
-	shift1      uint8 //MSB
-	shiftOffset uint8 //offset for external shift hardware
-}
-
-func Main(cpu *machine.Cpu) {
+// Main runs the game, cabinet devices are mapped on bus which becomes cpu IO
+func Main(cpu *machine.Cpu, bus *machine.Bus, opts Options) {
 
 	if err := sdl.Init(sdl.INIT_EVERYTHING); err != nil {
 		panic(err)
 	}
 	defer sdl.Quit()
 
-	window, err := sdl.CreateWindow("space invaders", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, 800, 600, sdl.WINDOW_SHOWN)
+	windowFlags := uint32(sdl.WINDOW_SHOWN | sdl.WINDOW_RESIZABLE)
+	if opts.Fullscreen {
+		windowFlags |= sdl.WINDOW_FULLSCREEN_DESKTOP
+	}
+	window, err := sdl.CreateWindow("space invaders", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, 800, 600, windowFlags)
 	if err != nil {
 		panic(err)
 	}
@@ -64,45 +165,119 @@ func Main(cpu *machine.Cpu) {
 		panic(err)
 	}
 
-	texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_RGBA8888, sdl.TEXTUREACCESS_STREAMING, width, height)
+	cab, err := newCabinet(renderer, opts)
 	if err != nil {
 		panic(err)
 	}
+	defer cab.destroy()
+
+	gameMachine := initEmulation(cpu, bus, opts)
+	if cab.hasArtwork() && cab.blend == sdl.BLENDMODE_BLEND {
+		gameMachine.offColor = 0
+	}
+
+	gameMachine.video, err = newVideo(window, renderer, cab, opts)
+	if err != nil {
+		panic(err)
+	}
+	defer gameMachine.video.destroy()
+
+	if opts.Record != "" {
+		if err := gameMachine.startRecording(opts.Record); err != nil {
+			panic(err)
+		}
+	}
+	defer gameMachine.stopRecording()
+	if opts.RecordAudio != "" {
+		if err := gameMachine.startAudioRecording(opts.RecordAudio); err != nil {
+			panic(err)
+		}
+	}
+	defer gameMachine.stopAudioRecording()
 
-	gameMachine := initEmulation(cpu)
+	loop(gameMachine)
+}
 
-	loop(window, texture, gameMachine)
+// Attach maps cabinet devices on bus without window and returns function which executes
+// one instruction and moves the beam, debuggers use it to step the game with its interrupts
+func Attach(cpu *machine.Cpu, bus *machine.Bus, opts Options) func() error {
+	return initEmulation(cpu, bus, opts).step
 }
 
-func loop(window *sdl.Window, texture *sdl.Texture, gameMachine *spaceInvadersMachine) {
-	renderer, _ := window.GetRenderer()
+func loop(gameMachine *spaceInvadersMachine) {
 	running := true
 
+	gameMachine.stopped = make(chan struct{})
 	go keyboardUpdate(gameMachine, &running)
 	go gameMachine.internalUpdate()
+	defer gameMachine.stopEmulation()
 
 	for running {
-		if gameMachine.pause == 2 {
-			gameMachine.syncPause.Wait()
+		// the last frame is drawn again when emulation stopped or paused
+		select {
+		case <-gameMachine.raster.ready:
+		case <-time.After(100 * time.Millisecond):
+		}
+		pixels := gameMachine.renderFrame()
+		gameMachine.osd.update(gameMachine.frame, gameMachine.cyclesRan.Load())
+		gameMachine.osd.draw(pixels, gameMachine.pause == 2)
+		if err := gameMachine.video.present(pixels); err != nil {
+			log.Fatal(err)
+		}
+		if request := gameMachine.screenshot.Swap(noScreenshot); request != noScreenshot {
+			if path, err := gameMachine.saveScreenshot(request == rawScreenshot); err != nil {
+				log.Printf("screenshot: %v", err)
+				gameMachine.notify("screenshot failed")
+			} else {
+				gameMachine.notify("screenshot saved to " + path)
+			}
 		}
-
-		renderer.Clear()
-		updateTexture(texture, gameMachine)
-		renderer.Copy(texture, nil, nil)
-		renderer.Present()
 		sdl.Delay(16)
 	}
 }
 
-func initEmulation(cpu *machine.Cpu) *spaceInvadersMachine {
+func initEmulation(cpu *machine.Cpu, bus *machine.Bus, opts Options) *spaceInvadersMachine {
 	gameMachine := &spaceInvadersMachine{
-		cpu:            cpu,
-		whichInterrupt: 1,
-		bitmap:         make([]byte, width*height*4),
-		syncPause:      &sync.WaitGroup{},
+		cpu:       cpu,
+		inputs:    newInputs(opts.Cocktail),
+		shift:     machine.NewShiftRegister(),
+		flip:      &flipLatch{},
+		sound:     newSound(),
+		offColor:  RGB_OFF,
+		watchdog:  &watchdog{logKick: opts.WatchdogLog},
+		opts:      opts,
+		raster:    newRaster(),
+		vram:      make([]byte, vramSize),
+		bitmap:    make([]byte, width*height*4),
+		osd:       newOSD(opts.ShowStats),
+		syncPause: &sync.WaitGroup{},
+	}
+	bus.Map(0, 2, gameMachine.inputs)
+	bus.Map(2, 4, gameMachine.shift)
+	bus.Map(6, 6, gameMachine.watchdog)
+	bus.Map(3, 3, gameMachine.sound)
+	bus.Map(5, 5, gameMachine.sound)
+	if opts.Cocktail {
+		bus.Map(5, 5, gameMachine.flip)
 	}
 	cpu.InterruptEnabled = true
-	cpu.IO_handler = &gameIO{}
+	cpu.IO = bus
+
+	gameMachine.overlays = Overlays
+	if opts.Overlay != nil {
+		current := slices.Index(Overlays, opts.Overlay)
+		if current < 0 {
+			current = len(Overlays)
+			gameMachine.overlays = append(slices.Clone(Overlays), opts.Overlay)
+		}
+		gameMachine.overlay.Store(int32(current))
+	}
+	for _, overlay := range gameMachine.overlays {
+		overlay.prepare()
+	}
+	if opts.Persistence > 0 {
+		gameMachine.persistence = newPersistence(opts.Persistence)
+	}
 	return gameMachine
 }
 
@@ -120,28 +295,78 @@ func (gameMachine *spaceInvadersMachine) internalUpdate() {
 	// 	}
 	// }(gameMachine)
 
-	for {
+	defer close(gameMachine.stopped)
+	for !gameMachine.stop.Load() {
 		if gameMachine.pause == 2 {
-			fmt.Println("pause")
 			gameMachine.syncPause.Wait()
 		}
-		gameMachine.cpu.Step()
-		op := gameMachine.cpu.GetCurrentOP()
-		cycles := op.Cycles
-
-		if gameMachine.cyclesRan-gameMachine.lastInterruptCycle > 33_333 {
-			if gameMachine.cpu.InterruptEnabled {
+		if err := gameMachine.step(); err != nil {
+			log.Printf("emulation stopped: %v", err)
+			return
+		}
+	}
+}
 
-				gameMachine.cpu.GenerateInterrupt(gameMachine.whichInterrupt)
+// stopEmulation stops internalUpdate and waits until it returns, so cpu and recorders
+// are not used by it after the window is closed
+func (gameMachine *spaceInvadersMachine) stopEmulation() {
+	gameMachine.stop.Store(true)
+	if gameMachine.pause == 2 {
+		gameMachine.pause = 0
+		gameMachine.syncPause.Done()
+	}
+	<-gameMachine.stopped
+}
 
-				// fmt.Println("interrupt")
-				gameMachine.lastInterruptCycle = gameMachine.cyclesRan
-				gameMachine.whichInterrupt ^= 3
-			}
+// step executes one instruction and moves beam by its cycles
+func (gameMachine *spaceInvadersMachine) step() error {
+	if err := gameMachine.cpu.Step(); err != nil && !errors.As(err, new(*machine.HaltedError)) {
+		return err
+	}
+	cycles := gameMachine.cpu.StepCycles()
+	gameMachine.cyclesRan.Add(uint64(cycles))
+	gameMachine.sound.advance(cycles)
+
+	if interrupt := gameMachine.raster.advance(gameMachine.cpu, cycles); interrupt != 0 {
+		// request is latched until the game enables interrupts
+		gameMachine.cpu.GenerateInterrupt(interrupt)
+		gameMachine.refreshes[interrupt-1].Add(1)
+		if interrupt == 2 {
+			gameMachine.vblank()
 		}
+	}
+	return nil
+}
 
-		gameMachine.cyclesRan += uint64(cycles)
+// vblank is called when raster completed frame
+func (gameMachine *spaceInvadersMachine) vblank() {
+	if gameMachine.opts.FrameReady != nil {
+		gameMachine.raster.lock.Lock()
+		gameMachine.opts.FrameReady(&gameMachine.raster.front)
+		gameMachine.raster.lock.Unlock()
+	}
+	gameMachine.recordFrame(&gameMachine.raster.front)
+	gameMachine.checkWatchdog()
+}
+
+// checkWatchdog is called once per frame, expired watchdog resets cpu and latches of the board
+// like reset line on real board, the beam starts a new frame
+func (gameMachine *spaceInvadersMachine) checkWatchdog() {
+	if !gameMachine.watchdog.frame() {
+		return
+	}
+	if gameMachine.opts.NoWatchdogReset {
+		log.Printf("watchdog expired at pc 0x%04x, reset disabled", gameMachine.cpu.GetPC())
+		return
 	}
+	log.Printf("watchdog expired at pc 0x%04x, resetting", gameMachine.cpu.GetPC())
+	gameMachine.watchdog.frames = 0
+	gameMachine.cpu.Reset()
+	gameMachine.cpu.ClearInterrupt()
+	gameMachine.shift.Reset()
+	gameMachine.sound.reset()
+	gameMachine.flip.flipped.Store(false)
+	gameMachine.raster.reset()
 }
 
 func keyboardUpdate(gameMachine *spaceInvadersMachine, running *bool) {
@@ -153,41 +378,105 @@ func keyboardUpdate(gameMachine *spaceInvadersMachine, running *bool) {
 				*running = false
 				break
 			case *sdl.KeyboardEvent:
-				gameMachine.handleKey(ev)
-
-				if ev.Keysym.Sym == sdl.K_p {
-					if ev.State == sdl.PRESSED {
-						if gameMachine.pause == 0 {
-							gameMachine.pause = 2
-							gameMachine.syncPause.Add(1)
-						} else if gameMachine.pause == 2 {
-							gameMachine.syncPause.Done()
-							gameMachine.pause = 0
-						}
-						break
-					}
+				// hotkeys are not wired to input ports of the board
+				if !gameMachine.handleHotkey(ev) {
+					gameMachine.handleKey(ev)
 				}
-
 			}
 		}
 	}
 
 }
 
-func updateTexture(texture *sdl.Texture, gameMachine *spaceInvadersMachine) {
-	buffer := gameMachine.cpu.CopyFrameBuffer()
+// handleHotkey runs emulator action on key press and reports whether key is a hotkey
+func (gameMachine *spaceInvadersMachine) handleHotkey(ev *sdl.KeyboardEvent) bool {
+	switch ev.Keysym.Sym {
+	case sdl.K_o, sdl.K_p, sdl.K_F7, sdl.K_F8, sdl.K_F9, sdl.K_F10, sdl.K_F11, sdl.K_F12:
+	default:
+		return false
+	}
+	if ev.State != sdl.PRESSED {
+		return true
+	}
+
+	switch ev.Keysym.Sym {
+	case sdl.K_o:
+		gameMachine.nextOverlay()
+	case sdl.K_p:
+		if gameMachine.pause == 0 {
+			gameMachine.pause = 2
+			gameMachine.syncPause.Add(1)
+		} else if gameMachine.pause == 2 {
+			gameMachine.syncPause.Done()
+			gameMachine.pause = 0
+		}
+	case sdl.K_F7:
+		if gameMachine.osd.toggleStats() {
+			gameMachine.notify("stats on")
+		} else {
+			gameMachine.notify("stats off")
+		}
+	case sdl.K_F8:
+		gameMachine.toggleRecording()
+	case sdl.K_F9:
+		gameMachine.notify("scale " + gameMachine.video.nextScaleMode())
+	case sdl.K_F10:
+		gameMachine.notify("filter " + gameMachine.video.nextFilter())
+	case sdl.K_F11:
+		gameMachine.video.toggleFullscreen()
+	case sdl.K_F12:
+		if ev.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
+			gameMachine.screenshot.Store(rawScreenshot)
+		} else {
+			gameMachine.screenshot.Store(colorScreenshot)
+		}
+	}
+	return true
+}
+
+func (gameMachine *spaceInvadersMachine) nextOverlay() {
+	next := (int(gameMachine.overlay.Load()) + 1) % len(gameMachine.overlays)
+	gameMachine.overlay.Store(int32(next))
+	gameMachine.notify("overlay " + gameMachine.overlays[next].Name)
+}
+
+// notify prints message to stdout and shows it on screen for a while
+func (gameMachine *spaceInvadersMachine) notify(message string) {
+	fmt.Println(message)
+	gameMachine.osd.show(message)
+}
+
+// renderFrame draws video RAM with color overlay into bitmap and returns its pixels
+func (gameMachine *spaceInvadersMachine) renderFrame() []uint32 {
+	gameMachine.frame = gameMachine.raster.latest(gameMachine.vram)
+	buffer := gameMachine.vram
+	if gameMachine.flip.flipped.Load() {
+		flipVRAM(buffer)
+	}
+	colors := gameMachine.overlays[gameMachine.overlay.Load()].colors
+	var decay [2]int
+	if gameMachine.persistence != nil {
+		decay = gameMachine.persistence.begin(&gameMachine.refreshes)
+	}
 
 	for x := 0; x < 224; x++ {
+		part := 0
+		if x >= midScreenLine {
+			part = 1
+		}
 		for y := 0; y < 256; y += 8 {
 			p := buffer[(x*(256/8))+y/8]
 			offset := (255-y)*(224*4) + (x * 4)
 			ptr := (*uint32)(unsafe.Pointer(&gameMachine.bitmap[offset]))
 
 			for i := 0; i < 8; i++ {
-				if p&0x1 == 1 {
-					*ptr = RGB_ON
+				idx := (255-y-i)*width + x
+				if gameMachine.persistence != nil {
+					*ptr = gameMachine.persistence.pixel(idx, p&0x1 == 1, colors[idx], gameMachine.offColor, decay[part])
+				} else if p&0x1 == 1 {
+					*ptr = colors[idx]
 				} else {
-					*ptr = RGB_OFF
+					*ptr = gameMachine.offColor
 				}
 
 				ptr = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(ptr)) - 224*4))
@@ -196,48 +485,14 @@ func updateTexture(texture *sdl.Texture, gameMachine *spaceInvadersMachine) {
 		}
 	}
 
-	pixels, _, err := texture.Lock(nil)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	copy(pixels, gameMachine.bitmap)
-	texture.Unlock()
-}
-
-func (io *gameIO) InPort(cpu *machine.Cpu) uint8 {
-
-	shift0 := io.shift0
-	shift1 := io.shift1
-	shiftOffset := io.shiftOffset
-	var accum uint8
-	pc := cpu.GetPC()
-	port := cpu.GetMemoryAt(pc + 1)
-	portVal := cpu.Ports[port]
-
-	switch port {
-	case 0:
-		return 1
-	case 1:
-		accum = portVal
-	case 3:
-		v := (uint16(shift1) << 8) | uint16(shift0)
-		accum = uint8((v >> (8 - shiftOffset)) & 0xff)
-	}
-	return accum
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&gameMachine.bitmap[0])), width*height)
 }
 
-func (io *gameIO) OutPort(cpu *machine.Cpu) {
-
-	port := cpu.GetMemoryAt(cpu.GetPC() + 1)
-	accum := cpu.GetAccumulator()
-	switch port {
-	case 2:
-		io.shiftOffset = accum & 0x7
-	case 4:
-		io.shift0 = io.shift1
-		io.shift1 = accum
+// flipVRAM rotates screen by 180 degrees which reverses order of all bits
+func flipVRAM(vram []byte) {
+	slices.Reverse(vram)
+	for i, b := range vram {
+		vram[i] = bits.Reverse8(b)
 	}
 }
 
@@ -253,6 +508,8 @@ func getSetBit(input sdl.Keycode) uint8 {
 		return 0x01
 	case start:
 		return 0x04
+	case start2:
+		return 0x02
 	default:
 		fmt.Println("Unknown input")
 		return 0
@@ -271,20 +528,31 @@ func getClearBit(input sdl.Keycode) uint8 {
 		return 0
 	case start:
 		return 0xfb
+	case start2:
+		return 0xfd
 	default:
 		fmt.Println("Unknown input")
-		return 0
+		return 0xff
 	}
 }
 
 func (gameMachine *spaceInvadersMachine) handleKey(ev *sdl.KeyboardEvent) {
 	var result uint8
-	port := &gameMachine.cpu.Ports[1]
+	port := &gameMachine.inputs.ports[1]
+	key := ev.Keysym.Sym
+	if player1Key, ok := player2Keys[key]; ok {
+		// upright cabinet has no player 2 panel
+		if !gameMachine.inputs.cocktail {
+			return
+		}
+		port = &gameMachine.inputs.ports[2]
+		key = player1Key
+	}
 
 	if ev.State == sdl.PRESSED {
-		result = *port | getSetBit(ev.Keysym.Sym)
+		result = *port | getSetBit(key)
 	} else {
-		result = *port & getClearBit(ev.Keysym.Sym)
+		result = *port & getClearBit(key)
 	}
 
 	*port = result
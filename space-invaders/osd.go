@@ -0,0 +1,211 @@
+package spacegameMachine
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+	// glyphAdvance leaves one pixel between characters and lines
+	glyphAdvance = glyphWidth + 1
+	lineAdvance  = glyphHeight + 2
+
+	messageTime = 2 * time.Second
+	maxMessages = 3
+)
+
+// osdFont is 5x7 font, rows have leftmost pixel in bit 4, text is upper cased and unknown runes are drawn as '?'
+var osdFont = map[rune][glyphHeight]uint8{
+	' ': {},
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x0a, 0x04, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'%': {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'?': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	'=': {0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00},
+	',': {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	'(': {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')': {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+}
+
+type osdMessage struct {
+	text    string
+	expires time.Time
+}
+
+// osd draws status messages, counters and pause banner over the frame before it is presented
+type osd struct {
+	lock     sync.Mutex
+	messages []osdMessage
+
+	showStats atomic.Bool
+	stats     string
+	// frames, cycles and renders at the start of the current stats second
+	since   time.Time
+	frames  uint64
+	cycles  uint64
+	renders int
+}
+
+func newOSD(showStats bool) *osd {
+	o := &osd{since: time.Now()}
+	o.showStats.Store(showStats)
+	return o
+}
+
+// show adds message below the ones still shown, it is safe to call from any goroutine
+func (o *osd) show(message string) {
+	o.lock.Lock()
+	o.messages = append(o.messages, osdMessage{text: message, expires: time.Now().Add(messageTime)})
+	if len(o.messages) > maxMessages {
+		o.messages = o.messages[len(o.messages)-maxMessages:]
+	}
+	o.lock.Unlock()
+}
+
+func (o *osd) toggleStats() bool {
+	show := !o.showStats.Load()
+	o.showStats.Store(show)
+	return show
+}
+
+// update is called by render loop with number of emulated frames and cycles,
+// counters are refreshed once per second
+func (o *osd) update(frame, cycles uint64) {
+	o.renders++
+	elapsed := time.Since(o.since)
+	if elapsed < time.Second {
+		return
+	}
+	fps := float64(o.renders) / elapsed.Seconds()
+	emulated := float64(frame-o.frames) / elapsed.Seconds()
+	perFrame := uint64(0)
+	if frame > o.frames {
+		perFrame = (cycles - o.cycles) / (frame - o.frames)
+	}
+	o.stats = fmt.Sprintf("FPS %.0f SPEED %.0f%% %d CYC/F", fps, emulated/60*100, perFrame)
+	o.since, o.frames, o.cycles, o.renders = time.Now(), frame, cycles, 0
+}
+
+// draw paints counters on top, message at the bottom and pause banner in the middle of pixels
+func (o *osd) draw(pixels []uint32, paused bool) {
+	if o.showStats.Load() && o.stats != "" {
+		drawText(pixels, o.stats, 2, 2, 1)
+	}
+
+	var lines []string
+	o.lock.Lock()
+	now := time.Now()
+	o.messages = slices.DeleteFunc(o.messages, func(m osdMessage) bool { return now.After(m.expires) })
+	for _, m := range o.messages {
+		lines = append(lines, wrapText(m.text, (width-4)/glyphAdvance)...)
+	}
+	o.lock.Unlock()
+	for i, line := range lines {
+		y := height - (len(lines)-i)*lineAdvance - 1
+		drawText(pixels, line, (width-len(line)*glyphAdvance)/2, y, 1)
+	}
+
+	if paused {
+		const banner = "PAUSED"
+		drawText(pixels, banner, (width-len(banner)*glyphAdvance*2)/2, (height-glyphHeight*2)/2, 2)
+	}
+}
+
+// drawText draws text scaled by scale on black box at x, y, pixels outside of the screen are clipped
+func drawText(pixels []uint32, text string, x, y, scale int) {
+	text = strings.ToUpper(text)
+	runes := []rune(text)
+	fill(pixels, x-scale, y-scale, (len(runes)*glyphAdvance+1)*scale, (glyphHeight+2)*scale, RGB_OFF)
+
+	for i, r := range runes {
+		glyph, ok := osdFont[r]
+		if !ok {
+			glyph = osdFont['?']
+		}
+		left := x + i*glyphAdvance*scale
+		for row, bits := range glyph {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(0x10>>col) != 0 {
+					fill(pixels, left+col*scale, y+row*scale, scale, scale, RGB_ON)
+				}
+			}
+		}
+	}
+}
+
+func fill(pixels []uint32, x, y, w, h int, color uint32) {
+	for py := max(y, 0); py < min(y+h, height); py++ {
+		for px := max(x, 0); px < min(x+w, width); px++ {
+			pixels[py*width+px] = color
+		}
+	}
+}
+
+// wrapText splits text into lines of at most columns runes, breaking at spaces where it can
+func wrapText(text string, columns int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len([]rune(line))+1+len([]rune(word)) <= columns {
+			line += " " + word
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		for len([]rune(word)) > columns {
+			lines = append(lines, string([]rune(word)[:columns]))
+			word = string([]rune(word)[columns:])
+		}
+		line = word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,145 @@
+package spacegameMachine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// colors in texture format RRGGBBAA
+const (
+	overlayRed    uint32 = 0xFF2020FF
+	overlayGreen  uint32 = 0x20FF20FF
+	overlayYellow uint32 = 0xFFFF20FF
+	overlayCyan   uint32 = 0x20FFFFFF
+	overlayOrange uint32 = 0xFF9020FF
+)
+
+// Band is cellophane strip covering screen rows [Top, Bottom] and columns [Left, Right]
+type Band struct {
+	Top, Bottom int
+	Left, Right int
+	Color       uint32
+}
+
+// Overlay colors lit pixels, pixels not covered by any band are RGB_ON
+type Overlay struct {
+	Name  string
+	Bands []Band
+
+	// colors is color of every screen pixel, built once by prepare
+	colors []uint32
+}
+
+func fullWidth(top, bottom int, color uint32) Band {
+	return Band{Top: top, Bottom: bottom, Left: 0, Right: width - 1, Color: color}
+}
+
+// Overlays are built in profiles selectable by -overlay and cycled with O key
+var Overlays = []*Overlay{
+	{
+		Name: "upright",
+		Bands: []Band{
+			fullWidth(32, 63, overlayRed),
+			fullWidth(184, 239, overlayGreen),
+			{Top: 240, Bottom: 255, Left: 16, Right: 133, Color: overlayGreen},
+		},
+	},
+	{
+		Name: "japanese",
+		Bands: []Band{
+			fullWidth(32, 63, overlayRed),
+			fullWidth(64, 95, overlayOrange),
+			fullWidth(96, 127, overlayYellow),
+			fullWidth(128, 183, overlayCyan),
+			fullWidth(184, 239, overlayGreen),
+			{Top: 240, Bottom: 255, Left: 16, Right: 133, Color: overlayGreen},
+		},
+	},
+	{Name: "mono"},
+}
+
+// FindOverlay returns built in profile by name, any other name is loaded as overlay file
+func FindOverlay(name string) (*Overlay, error) {
+	for _, overlay := range Overlays {
+		if overlay.Name == name {
+			return overlay, nil
+		}
+	}
+	return LoadOverlay(name)
+}
+
+// LoadOverlay reads custom overlay, every line is band "top bottom RRGGBB [left right]",
+// rows and columns are in 224x256 screen pixels, lines starting with # are comments
+func LoadOverlay(path string) (*Overlay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	overlay := &Overlay{Name: filepath.Base(path)}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		band, err := parseBand(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		overlay.Bands = append(overlay.Bands, band)
+	}
+	return overlay, scanner.Err()
+}
+
+func parseBand(fields []string) (Band, error) {
+	if len(fields) != 3 && len(fields) != 5 {
+		return Band{}, fmt.Errorf("band must be \"top bottom RRGGBB [left right]\"")
+	}
+	band := Band{Left: 0, Right: width - 1}
+	color, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "#"), 16, 24)
+	if err != nil {
+		return Band{}, fmt.Errorf("bad color %q", fields[2])
+	}
+	band.Color = uint32(color)<<8 | 0xFF
+
+	coords := []*int{&band.Top, &band.Bottom}
+	values := []string{fields[0], fields[1]}
+	if len(fields) == 5 {
+		coords = append(coords, &band.Left, &band.Right)
+		values = append(values, fields[3], fields[4])
+	}
+	for i, value := range values {
+		if *coords[i], err = strconv.Atoi(value); err != nil {
+			return Band{}, fmt.Errorf("bad coordinate %q", value)
+		}
+	}
+	if band.Top < 0 || band.Bottom >= height || band.Top > band.Bottom ||
+		band.Left < 0 || band.Right >= width || band.Left > band.Right {
+		return Band{}, fmt.Errorf("band is outside of %dx%d screen", width, height)
+	}
+	return band, nil
+}
+
+// prepare builds color map, later bands cover earlier ones
+func (overlay *Overlay) prepare() {
+	if overlay.colors != nil {
+		return
+	}
+	overlay.colors = make([]uint32, width*height)
+	for i := range overlay.colors {
+		overlay.colors[i] = RGB_ON
+	}
+	for _, band := range overlay.Bands {
+		for y := band.Top; y <= band.Bottom; y++ {
+			for x := band.Left; x <= band.Right; x++ {
+				overlay.colors[y*width+x] = band.Color
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package spacegameMachine
+
+import "sync/atomic"
+
+// midScreenLine is raster line drawn when mid-screen interrupt RST 1 is raised, VBlank RST 2
+// comes after the last one. Raster lines are screen columns because monitor is rotated
+const midScreenLine = 96
+
+// persistence models phosphor decay: pixel lit by beam fades out over given number of
+// frames. Each part of screen decays only when beam passed it, which is counted by interrupts
+type persistence struct {
+	step      int
+	intensity []uint8
+	// seen are refresh counts of both screen parts at the previous render
+	seen [2]uint64
+}
+
+func newPersistence(frames int) *persistence {
+	return &persistence{
+		step:      (255 + frames - 1) / frames,
+		intensity: make([]uint8, width*height),
+	}
+}
+
+// begin returns how much screen parts above and below midScreenLine faded since previous render
+func (p *persistence) begin(refreshes *[2]atomic.Uint64) [2]int {
+	var decay [2]int
+	for i := range decay {
+		count := refreshes[i].Load()
+		decay[i] = int(count-p.seen[i]) * p.step
+		p.seen[i] = count
+	}
+	return decay
+}
+
+// pixel returns color of pixel which is lit or fades after decay, color is overlay color of pixel
+func (p *persistence) pixel(idx int, lit bool, color, off uint32, decay int) uint32 {
+	level := int(p.intensity[idx])
+	if lit {
+		level = 0xFF
+	} else {
+		level = max(0, level-decay)
+	}
+	p.intensity[idx] = uint8(level)
+	if level == 0 {
+		return off
+	}
+	return scaleColor(color, level) | off
+}
+
+// scaleColor multiplies all channels by level/255
+func scaleColor(c uint32, level int) uint32 {
+	var res uint32
+	for shift := 0; shift < 32; shift += 8 {
+		channel := (c >> shift) & 0xFF
+		res |= channel * uint32(level) / 0xFF << shift
+	}
+	return res
+}
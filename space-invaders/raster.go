@@ -0,0 +1,98 @@
+package spacegameMachine
+
+import (
+	"cpu-emulator/machine"
+	"sync"
+)
+
+// beam timing of the board, frame has 262 lines and beam is in VBlank after the last visible one.
+// Cycles are cpu clock periods (T states) as returned by Cpu.StepCycles
+const (
+	cpuClock       = 2_000_000
+	cyclesPerFrame = cpuClock / 60
+	totalLines     = 262
+	vblankLine     = width
+	lineBytes      = height / 8
+	vramSize       = width * lineBytes
+)
+
+// Frame is complete screen latched line by line as beam moved over it
+type Frame struct {
+	// Number counts VBlanks since start
+	Number uint64
+	VRAM   []byte
+}
+
+// raster follows beam position by cpu cycles. Every line is copied from VRAM when beam draws it,
+// so changes made by the game after that show up in the next frame like on real monitor
+type raster struct {
+	cycles int
+	// line is the next line to latch
+	line int
+	back []byte
+
+	// lock guards front frame which is read by renderer
+	lock  sync.Mutex
+	front Frame
+	// ready is signaled when front frame is replaced
+	ready chan struct{}
+}
+
+func newRaster() *raster {
+	return &raster{
+		back:  make([]byte, vramSize),
+		front: Frame{VRAM: make([]byte, vramSize)},
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// advance moves beam by cycles and latches lines it passed. It returns interrupt raised
+// by beam: 1 at midScreenLine, 2 at VBlank or 0, frame is complete when it returns 2
+func (r *raster) advance(cpu *machine.Cpu, cycles int) int {
+	r.cycles += cycles
+	beam := min(r.cycles*totalLines/cyclesPerFrame, vblankLine)
+
+	interrupt := 0
+	for ; r.line < beam; r.line++ {
+		cpu.ReadMemory(machine.VRAMStart+uint16(r.line*lineBytes), r.back[r.line*lineBytes:(r.line+1)*lineBytes])
+		switch r.line + 1 {
+		case midScreenLine:
+			interrupt = 1
+		case vblankLine:
+			r.publish()
+			interrupt = 2
+		}
+	}
+
+	if r.cycles >= cyclesPerFrame {
+		r.cycles -= cyclesPerFrame
+		r.line = 0
+	}
+	return interrupt
+}
+
+// reset moves beam to the top of a new frame, already published frame is kept
+func (r *raster) reset() {
+	r.cycles = 0
+	r.line = 0
+}
+
+func (r *raster) publish() {
+	r.lock.Lock()
+	r.front.VRAM, r.back = r.back, r.front.VRAM
+	r.front.Number++
+	r.lock.Unlock()
+
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+// latest copies VRAM of the last complete frame into dst and returns its number
+func (r *raster) latest(dst []byte) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	copy(dst, r.front.VRAM)
+	return r.front.Number
+}
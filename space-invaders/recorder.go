@@ -0,0 +1,303 @@
+package spacegameMachine
+
+import (
+	"bufio"
+	"bytes"
+	"cpu-emulator/machine"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// recorder writes every emulated frame to animated GIF or uncompressed Y4M stream
+type recorder struct {
+	path string
+	file *os.File
+	w    *bufio.Writer
+
+	// overlay colors frames, nil records raw 1-bit VRAM
+	overlay *Overlay
+	palette color.Palette
+
+	// anim collects GIF frames of the current clip, it is encoded when gifClipImages are
+	// collected or recording stops. clips counts files, the following ones are <name>-<n>.gif
+	anim   *gif.GIF
+	clips  int
+	frames int
+}
+
+func newRecorder(path string, overlay *Overlay) (*recorder, error) {
+	ext := filepath.Ext(path)
+	if ext != ".gif" && ext != ".y4m" {
+		return nil, fmt.Errorf("recording %s: format must be .gif or .y4m", path)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recorder{
+		path:    path,
+		file:    file,
+		w:       bufio.NewWriter(file),
+		overlay: overlay,
+		palette: color.Palette{color.Black, color.White},
+	}
+	if overlay != nil {
+		rec.palette = overlayPalette(overlay)
+	}
+
+	if ext == ".gif" {
+		rec.anim = &gif.GIF{Config: image.Config{ColorModel: rec.palette, Width: width, Height: height}}
+		rec.clips = 1
+	} else if _, err := fmt.Fprintf(rec.w, "YUV4MPEG2 W%d H%d F60:1 Ip A1:1 C444\n", width, height); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+// overlayPalette returns black followed by all colors of overlay
+func overlayPalette(overlay *Overlay) color.Palette {
+	palette := color.Palette{color.Black}
+	seen := map[uint32]bool{}
+	for _, c := range overlay.colors {
+		if !seen[c] && len(palette) < 256 {
+			seen[c] = true
+			palette = append(palette, rgba(c))
+		}
+	}
+	return palette
+}
+
+// rgba converts texture color RRGGBBAA
+func rgba(c uint32) color.RGBA {
+	return color.RGBA{R: uint8(c >> 24), G: uint8(c >> 16), B: uint8(c >> 8), A: 0xFF}
+}
+
+func (rec *recorder) image(vram []byte) *image.Paletted {
+	img := machine.VRAMImage(vram)
+	if rec.overlay == nil {
+		return img
+	}
+	img.Palette = rec.palette
+	for i, lit := range img.Pix {
+		if lit == 1 {
+			img.Pix[i] = uint8(rec.palette.Index(rgba(rec.overlay.colors[i])))
+		}
+	}
+	return img
+}
+
+// frame records VRAM of complete frame
+func (rec *recorder) frame(vram []byte) error {
+	img := rec.image(vram)
+	rec.frames++
+	if rec.anim != nil {
+		return rec.gifFrame(img)
+	}
+	return rec.y4mFrame(img)
+}
+
+const (
+	// gifFrameDelay is 1/50 s, players slow down shorter delays, so GIF runs at 50 frames
+	// per second and every 6th frame is dropped
+	gifFrameDelay = 2
+	// gifClipImages bounds memory taken by frames waiting for gif.EncodeAll
+	gifClipImages = 500
+)
+
+// gifFrame appends frames which fall on 50 fps clock. Frame equal to the previous one
+// only makes it last longer
+func (rec *recorder) gifFrame(img *image.Paletted) error {
+	if rec.frames*50/60 == (rec.frames-1)*50/60 {
+		return nil
+	}
+	last := len(rec.anim.Image) - 1
+	if last >= 0 && bytes.Equal(rec.anim.Image[last].Pix, img.Pix) && rec.anim.Delay[last] < math.MaxUint16-gifFrameDelay {
+		rec.anim.Delay[last] += gifFrameDelay
+		return nil
+	}
+	if len(rec.anim.Image) == gifClipImages {
+		if err := rec.nextClip(); err != nil {
+			return err
+		}
+	}
+	rec.anim.Image = append(rec.anim.Image, img)
+	rec.anim.Delay = append(rec.anim.Delay, gifFrameDelay)
+	return nil
+}
+
+// nextClip writes collected frames and continues recording to the next file
+func (rec *recorder) nextClip() error {
+	if err := rec.closeFile(); err != nil {
+		return err
+	}
+	rec.clips++
+	ext := filepath.Ext(rec.path)
+	file, err := os.Create(fmt.Sprintf("%s-%d%s", strings.TrimSuffix(rec.path, ext), rec.clips, ext))
+	if err != nil {
+		return err
+	}
+	rec.file, rec.w = file, bufio.NewWriter(file)
+	rec.anim.Image, rec.anim.Delay = nil, nil
+	return nil
+}
+
+func (rec *recorder) y4mFrame(img *image.Paletted) error {
+	var planes [3][]byte
+	for i := range planes {
+		planes[i] = make([]byte, len(img.Pix))
+	}
+	for i, index := range img.Pix {
+		r, g, b, _ := img.Palette[index].RGBA()
+		planes[0][i], planes[1][i], planes[2][i] = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+	}
+
+	rec.w.WriteString("FRAME\n")
+	for _, plane := range planes {
+		if _, err := rec.w.Write(plane); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close finishes the file
+func (rec *recorder) close() error {
+	return rec.closeFile()
+}
+
+// closeFile encodes collected GIF frames, flushes and closes the current file
+func (rec *recorder) closeFile() error {
+	var err error
+	if rec.anim != nil && len(rec.anim.Image) > 0 {
+		err = gif.EncodeAll(rec.w, rec.anim)
+	}
+	if err == nil {
+		err = rec.w.Flush()
+	}
+	if closeErr := rec.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// startRecording records following frames to path, current overlay is used unless RecordRaw is set
+func (gameMachine *spaceInvadersMachine) startRecording(path string) error {
+	var overlay *Overlay
+	if !gameMachine.opts.RecordRaw {
+		overlay = gameMachine.overlays[gameMachine.overlay.Load()]
+	}
+	rec, err := newRecorder(path, overlay)
+	if err != nil {
+		return err
+	}
+
+	gameMachine.recordLock.Lock()
+	gameMachine.recorder = rec
+	gameMachine.recordLock.Unlock()
+	gameMachine.notify("recording to " + path)
+	return nil
+}
+
+func (gameMachine *spaceInvadersMachine) stopRecording() {
+	gameMachine.recordLock.Lock()
+	rec := gameMachine.recorder
+	gameMachine.recorder = nil
+	gameMachine.recordLock.Unlock()
+
+	if rec == nil {
+		return
+	}
+	if err := rec.close(); err != nil {
+		log.Printf("recording %s: %v", rec.path, err)
+		return
+	}
+	if rec.clips > 1 {
+		gameMachine.notify(fmt.Sprintf("recorded %d frames to %s and %d more clips", rec.frames, rec.path, rec.clips-1))
+		return
+	}
+	gameMachine.notify(fmt.Sprintf("recorded %d frames to %s", rec.frames, rec.path))
+}
+
+// toggleRecording is bound to hotkey, video gets extension of -record path or .gif
+// and audio is recorded to WAV alongside
+func (gameMachine *spaceInvadersMachine) toggleRecording() {
+	gameMachine.recordLock.Lock()
+	recording := gameMachine.recorder != nil
+	gameMachine.recordLock.Unlock()
+	if recording {
+		gameMachine.stopRecording()
+		gameMachine.stopAudioRecording()
+		return
+	}
+
+	ext := ".gif"
+	if gameMachine.opts.Record != "" {
+		ext = filepath.Ext(gameMachine.opts.Record)
+	}
+	gameMachine.raster.lock.Lock()
+	frame := gameMachine.raster.front.Number
+	gameMachine.raster.lock.Unlock()
+	base := fmt.Sprintf("recording-%06d", frame)
+	if err := gameMachine.startRecording(base + ext); err != nil {
+		log.Print(err)
+		return
+	}
+	if err := gameMachine.startAudioRecording(base + ".wav"); err != nil {
+		log.Print(err)
+	}
+}
+
+// startAudioRecording attaches WAV writer to sound mixer, it gets every produced sample
+func (gameMachine *spaceInvadersMachine) startAudioRecording(path string) error {
+	wav, err := newWavWriter(path)
+	if err != nil {
+		return err
+	}
+	if prev := gameMachine.sound.record(wav); prev != nil {
+		prev.close()
+	}
+	gameMachine.notify("recording audio to " + path)
+	return nil
+}
+
+func (gameMachine *spaceInvadersMachine) stopAudioRecording() {
+	wav := gameMachine.sound.record(nil)
+	if wav == nil {
+		return
+	}
+	if err := wav.close(); err != nil {
+		log.Printf("audio recording %s: %v", wav.path, err)
+		return
+	}
+	gameMachine.notify(fmt.Sprintf("recorded %d samples to %s", wav.samples, wav.path))
+}
+
+// recordFrame is called at VBlank from emulation goroutine
+func (gameMachine *spaceInvadersMachine) recordFrame(frame *Frame) {
+	gameMachine.recordLock.Lock()
+	defer gameMachine.recordLock.Unlock()
+	if gameMachine.recorder == nil {
+		return
+	}
+
+	vram := frame.VRAM
+	if gameMachine.flip.flipped.Load() {
+		vram = slices.Clone(vram)
+		flipVRAM(vram)
+	}
+	if err := gameMachine.recorder.frame(vram); err != nil {
+		log.Printf("recording %s: %v", gameMachine.recorder.path, err)
+		gameMachine.recorder.close()
+		gameMachine.recorder = nil
+	}
+}
@@ -0,0 +1,97 @@
+package spacegameMachine
+
+import (
+	"cpu-emulator/machine"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+)
+
+// screenshot requests passed from keyboard to render loop
+const (
+	noScreenshot int32 = iota
+	colorScreenshot
+	rawScreenshot
+)
+
+// frameImage returns the last complete frame with overlay applied or raw 1-bit VRAM and its number
+func (gameMachine *spaceInvadersMachine) frameImage(raw bool) (image.Image, uint64) {
+	if raw {
+		vram := make([]byte, vramSize)
+		frame := gameMachine.raster.latest(vram)
+		if gameMachine.flip.flipped.Load() {
+			flipVRAM(vram)
+		}
+		return machine.VRAMImage(vram), frame
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, c := range gameMachine.renderFrame() {
+		img.SetNRGBA(i%width, i/width, color.NRGBA{R: uint8(c >> 24), G: uint8(c >> 16), B: uint8(c >> 8), A: uint8(c)})
+	}
+	return img, gameMachine.frame
+}
+
+// saveScreenshot writes the last frame to screenshot-<frame>.png, metadata is stored in PNG text chunks
+func (gameMachine *spaceInvadersMachine) saveScreenshot(raw bool) (string, error) {
+	img, frame := gameMachine.frameImage(raw)
+	path := fmt.Sprintf("screenshot-%06d.png", frame)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	text := map[string]string{
+		"Software": "cpu-emulator",
+		"Frame":    strconv.FormatUint(frame, 10),
+	}
+	if gameMachine.opts.ROMHash != "" {
+		text["ROM SHA-256"] = gameMachine.opts.ROMHash
+	}
+	if err := machine.WritePNG(f, img, text); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// Headless runs the game without window until frame is complete. Record and RecordAudio
+// in opts are recorded meanwhile and screenshot of frame screenshotAt is saved unless it is 0
+func Headless(cpu *machine.Cpu, bus *machine.Bus, opts Options, frame, screenshotAt uint64) error {
+	gameMachine := initEmulation(cpu, bus, opts)
+	if opts.Record != "" {
+		if err := gameMachine.startRecording(opts.Record); err != nil {
+			return err
+		}
+		defer gameMachine.stopRecording()
+	}
+	if opts.RecordAudio != "" {
+		if err := gameMachine.startAudioRecording(opts.RecordAudio); err != nil {
+			return err
+		}
+		defer gameMachine.stopAudioRecording()
+	}
+
+	if screenshotAt > 0 {
+		if err := gameMachine.runUntil(screenshotAt); err != nil {
+			return err
+		}
+		path, err := gameMachine.saveScreenshot(opts.ScreenshotRaw)
+		if err != nil {
+			return err
+		}
+		fmt.Println("screenshot saved to", path)
+	}
+	return gameMachine.runUntil(frame)
+}
+
+func (gameMachine *spaceInvadersMachine) runUntil(frame uint64) error {
+	for gameMachine.raster.front.Number < frame {
+		if err := gameMachine.step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
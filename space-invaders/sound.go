@@ -0,0 +1,190 @@
+package spacegameMachine
+
+import (
+	"log"
+	"math"
+	"sync"
+)
+
+const sampleRate = 44100
+
+// ampEnable is bit 5 of port 3 which turns sound amplifier on
+const ampEnable = 0x20
+
+// voice is one of discrete sound circuits of the board, it is triggered by rising edge
+// of its bit on port 3 or 5. Sounds are synthesized, board had analog circuits for them
+type voice struct {
+	port uint8
+	bit  uint8
+	// duration in samples, 0 plays while the bit is set
+	duration int
+	gen      func(v *voice, s *sound) float64
+
+	playing bool
+	t       int
+	phase   float64
+}
+
+// square returns square wave of freq, phase is kept between samples so freq can change
+func (v *voice) square(freq float64) float64 {
+	v.phase += freq / sampleRate
+	v.phase -= math.Floor(v.phase)
+	if v.phase < 0.5 {
+		return 1
+	}
+	return -1
+}
+
+// decay is envelope falling to 1/e after seconds
+func (v *voice) decay(seconds float64) float64 {
+	return math.Exp(-float64(v.t) / (seconds * sampleRate))
+}
+
+func newVoices() []*voice {
+	fleet := func(bit uint8, freq float64) *voice {
+		return &voice{port: 5, bit: bit, duration: sampleRate / 8, gen: func(v *voice, s *sound) float64 {
+			return v.square(freq) * v.decay(0.05)
+		}}
+	}
+	return []*voice{
+		// UFO warbles while it flies
+		{port: 3, bit: 0x01, gen: func(v *voice, s *sound) float64 {
+			return 0.5 * v.square(700+150*math.Sin(2*math.Pi*6*float64(v.t)/sampleRate))
+		}},
+		// shot
+		{port: 3, bit: 0x02, duration: sampleRate * 3 / 10, gen: func(v *voice, s *sound) float64 {
+			return s.noise() * v.decay(0.08)
+		}},
+		// player death
+		{port: 3, bit: 0x04, duration: sampleRate, gen: func(v *voice, s *sound) float64 {
+			return s.noise() * v.decay(0.3)
+		}},
+		// invader death
+		{port: 3, bit: 0x08, duration: sampleRate / 4, gen: func(v *voice, s *sound) float64 {
+			return 0.7 * v.square(1200-3000*float64(v.t)/sampleRate) * v.decay(0.1)
+		}},
+		// extra life beeps
+		{port: 3, bit: 0x10, duration: sampleRate, gen: func(v *voice, s *sound) float64 {
+			if v.t/(sampleRate/8)%2 == 1 {
+				return 0
+			}
+			return 0.5 * v.square(1500)
+		}},
+		fleet(0x01, 62),
+		fleet(0x02, 58),
+		fleet(0x04, 54),
+		fleet(0x08, 50),
+		// UFO hit
+		{port: 5, bit: 0x10, duration: sampleRate, gen: func(v *voice, s *sound) float64 {
+			return 0.5 * v.square(900-600*float64(v.t)/sampleRate)
+		}},
+	}
+}
+
+// sound is mixer of all voices driven by OUT 3 and OUT 5. Samples are produced by cpu
+// cycles, not wall clock, so the same run always produces the same samples
+type sound struct {
+	port3, port5 uint8
+	voices       []*voice
+	// pending is remainder of cycles*sampleRate which didn't make full sample yet
+	pending uint64
+	lfsr    uint16
+
+	// lock guards wav, it is attached by hotkey while game runs
+	lock sync.Mutex
+	wav  *wavWriter
+}
+
+func newSound() *sound {
+	return &sound{voices: newVoices(), lfsr: 0xACE1}
+}
+
+func (s *sound) In(port uint8) uint8 {
+	return 0
+}
+
+func (s *sound) Out(port uint8, val uint8) {
+	prev := &s.port3
+	if port == 5 {
+		prev = &s.port5
+	}
+	rising := val &^ *prev
+	*prev = val
+
+	for _, v := range s.voices {
+		if v.port != port {
+			continue
+		}
+		if rising&v.bit != 0 {
+			v.playing, v.t, v.phase = true, 0, 0
+		}
+		if v.duration == 0 && val&v.bit == 0 {
+			v.playing = false
+		}
+	}
+}
+
+// reset clears port latches and silences all voices
+func (s *sound) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.port3, s.port5 = 0, 0
+	for _, v := range s.voices {
+		v.playing = false
+	}
+}
+
+// noise is 16 bit LFSR, it is deterministic unlike random generator
+func (s *sound) noise() float64 {
+	bit := (s.lfsr ^ s.lfsr>>2 ^ s.lfsr>>3 ^ s.lfsr>>5) & 1
+	s.lfsr = s.lfsr>>1 | bit<<15
+	return float64(s.lfsr&1)*2 - 1
+}
+
+// advance produces samples for cycles of emulated time
+func (s *sound) advance(cycles int) {
+	s.pending += uint64(cycles) * sampleRate
+	if s.pending < cpuClock {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for ; s.pending >= cpuClock; s.pending -= cpuClock {
+		sample := s.sample()
+		if s.wav != nil {
+			if err := s.wav.write(sample); err != nil {
+				log.Printf("audio recording %s: %v", s.wav.path, err)
+				s.wav.close()
+				s.wav = nil
+			}
+		}
+	}
+}
+
+func (s *sound) sample() int16 {
+	var mix float64
+	for _, v := range s.voices {
+		if !v.playing {
+			continue
+		}
+		mix += v.gen(v, s)
+		v.t++
+		if v.duration > 0 && v.t >= v.duration {
+			v.playing = false
+		}
+	}
+	if s.port3&ampEnable == 0 {
+		return 0
+	}
+	mix = max(-1, min(1, mix*0.3))
+	return int16(mix * math.MaxInt16)
+}
+
+// record attaches WAV writer, nil stops recording and returns the previous writer
+func (s *sound) record(wav *wavWriter) *wavWriter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev := s.wav
+	s.wav = wav
+	return prev
+}
@@ -0,0 +1,185 @@
+package spacegameMachine
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// ScaleModes are ways screen fills window: aspect keeps 224:256 ratio with letterbox,
+// integer uses the biggest whole multiple of screen size and stretch fills whole window
+var ScaleModes = []string{"aspect", "integer", "stretch"}
+
+// video uploads rendered frames through filter into texture and places it in window.
+// Settings are changed from keyboard goroutine and applied by the render loop
+type video struct {
+	window   *sdl.Window
+	renderer *sdl.Renderer
+	cab      *cabinet
+
+	// textures are created for every filter scale when first needed
+	textures map[int]*sdl.Texture
+	out      []uint32
+
+	filter     atomic.Int32
+	scaleMode  atomic.Int32
+	fullscreen atomic.Bool
+	// isFullscreen is current window state, fullscreen is the requested one
+	isFullscreen bool
+	// rotation is clockwise angle of screen for rotated monitors
+	rotation int
+}
+
+func newVideo(window *sdl.Window, renderer *sdl.Renderer, cab *cabinet, opts Options) (*video, error) {
+	v := &video{
+		window:       window,
+		renderer:     renderer,
+		cab:          cab,
+		textures:     map[int]*sdl.Texture{},
+		isFullscreen: opts.Fullscreen,
+		rotation:     opts.Rotation,
+	}
+	if opts.Rotation%90 != 0 || opts.Rotation < 0 || opts.Rotation >= 360 {
+		return nil, fmt.Errorf("rotation must be 0, 90, 180 or 270, got %d", opts.Rotation)
+	}
+	v.fullscreen.Store(opts.Fullscreen)
+
+	if opts.Filter != "" {
+		filter := slices.IndexFunc(Filters, func(f *Filter) bool { return f.Name == opts.Filter })
+		if filter < 0 {
+			return nil, fmt.Errorf("unknown filter %q", opts.Filter)
+		}
+		v.filter.Store(int32(filter))
+	}
+	if opts.ScaleMode != "" {
+		mode := slices.Index(ScaleModes, opts.ScaleMode)
+		if mode < 0 {
+			return nil, fmt.Errorf("unknown scale mode %q", opts.ScaleMode)
+		}
+		v.scaleMode.Store(int32(mode))
+	}
+	return v, nil
+}
+
+// nextFilter switches to the next filter and returns its name
+func (v *video) nextFilter() string {
+	next := (int(v.filter.Load()) + 1) % len(Filters)
+	v.filter.Store(int32(next))
+	return Filters[next].Name
+}
+
+// nextScaleMode switches to the next scale mode and returns its name
+func (v *video) nextScaleMode() string {
+	next := (int(v.scaleMode.Load()) + 1) % len(ScaleModes)
+	v.scaleMode.Store(int32(next))
+	return ScaleModes[next]
+}
+
+func (v *video) toggleFullscreen() {
+	v.fullscreen.Store(!v.fullscreen.Load())
+}
+
+func (v *video) texture(scale int) (*sdl.Texture, error) {
+	if texture, ok := v.textures[scale]; ok {
+		return texture, nil
+	}
+	texture, err := v.renderer.CreateTexture(sdl.PIXELFORMAT_RGBA8888, sdl.TEXTUREACCESS_STREAMING, int32(width*scale), int32(height*scale))
+	if err != nil {
+		return nil, err
+	}
+	if v.cab.hasArtwork() {
+		texture.SetBlendMode(v.cab.blend)
+	}
+	v.textures[scale] = texture
+	return texture, nil
+}
+
+// present filters frame of width x height pixels and draws it with cabinet artwork
+func (v *video) present(frame []uint32) error {
+	if fullscreen := v.fullscreen.Load(); fullscreen != v.isFullscreen {
+		var flags uint32
+		if fullscreen {
+			flags = sdl.WINDOW_FULLSCREEN_DESKTOP
+		}
+		if err := v.window.SetFullscreen(flags); err != nil {
+			return err
+		}
+		v.isFullscreen = fullscreen
+	}
+
+	filter := Filters[v.filter.Load()]
+	texture, err := v.texture(filter.Scale)
+	if err != nil {
+		return err
+	}
+	size := width * height * filter.Scale * filter.Scale
+	if len(v.out) < size {
+		v.out = make([]uint32, size)
+	}
+	filter.apply(v.out, frame, width, height)
+
+	pixels, _, err := texture.Lock(nil)
+	if err != nil {
+		return err
+	}
+	copy(pixels, unsafe.Slice((*byte)(unsafe.Pointer(&v.out[0])), size*4))
+	texture.Unlock()
+
+	v.renderer.Clear()
+	w, h, _ := v.renderer.GetOutputSize()
+	v.cab.draw(v.renderer, texture, v.rotate(v.place(w, h), w, h), float64(v.rotation))
+	v.renderer.Present()
+	return nil
+}
+
+// place returns placement of screen as seen after rotation in window of given size, nil fills whole window
+func (v *video) place(windowW, windowH int32) *sdl.Rect {
+	if v.cab.screen != nil {
+		return v.cab.screen
+	}
+	screenW, screenH := int32(width), int32(height)
+	if v.rotation%180 != 0 {
+		screenW, screenH = screenH, screenW
+	}
+	var w, h int32
+	switch ScaleModes[v.scaleMode.Load()] {
+	case "stretch":
+		return nil
+	case "integer":
+		scale := min(windowW/screenW, windowH/screenH)
+		if scale >= 1 {
+			w, h = screenW*scale, screenH*scale
+			break
+		}
+		fallthrough
+	default:
+		h = windowH
+		w = h * screenW / screenH
+		if w > windowW {
+			w = windowW
+			h = w * screenH / screenW
+		}
+	}
+	return &sdl.Rect{X: (windowW - w) / 2, Y: (windowH - h) / 2, W: w, H: h}
+}
+
+// rotate returns rect which covers placement after rotation around its center
+func (v *video) rotate(placement *sdl.Rect, windowW, windowH int32) *sdl.Rect {
+	if v.rotation%180 == 0 {
+		return placement
+	}
+	if placement == nil {
+		placement = &sdl.Rect{W: windowW, H: windowH}
+	}
+	centerX, centerY := placement.X+placement.W/2, placement.Y+placement.H/2
+	return &sdl.Rect{X: centerX - placement.H/2, Y: centerY - placement.W/2, W: placement.H, H: placement.W}
+}
+
+func (v *video) destroy() {
+	for _, texture := range v.textures {
+		texture.Destroy()
+	}
+}
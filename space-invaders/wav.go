@@ -0,0 +1,67 @@
+package spacegameMachine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+)
+
+// wavWriter writes 16-bit mono PCM, sizes in header are filled in when it is closed
+type wavWriter struct {
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	samples uint32
+}
+
+func newWavWriter(path string) (*wavWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	wav := &wavWriter{path: path, file: file, w: bufio.NewWriter(file)}
+	if err := wav.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (wav *wavWriter) writeHeader() error {
+	dataSize := wav.samples * 2
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16),
+		uint16(1), uint16(1), uint32(sampleRate), uint32(sampleRate * 2), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	for _, field := range header {
+		if err := binary.Write(wav.w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wav *wavWriter) write(sample int16) error {
+	wav.samples++
+	return binary.Write(wav.w, binary.LittleEndian, sample)
+}
+
+// close flushes samples, rewrites header with final sizes and closes the file
+func (wav *wavWriter) close() error {
+	err := wav.w.Flush()
+	if err == nil {
+		_, err = wav.file.Seek(0, 0)
+	}
+	if err == nil {
+		err = wav.writeHeader()
+	}
+	if err == nil {
+		err = wav.w.Flush()
+	}
+	if closeErr := wav.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
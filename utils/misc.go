@@ -1,7 +1,5 @@
 package misc
 
-import "log"
-
 func RegToString(code uint8) string {
 	switch code & 0b111 {
 	case 0x07:
@@ -18,11 +16,8 @@ func RegToString(code uint8) string {
 		return "H"
 	case 0x05:
 		return "L"
-	case 0x06:
-		return "MEM"
 	default:
-		log.Fatal("Invalid register code %d", code)
-		return ""
+		return "MEM"
 	}
 }
 
@@ -34,11 +29,8 @@ func RegPairToString(code uint8) string {
 		return "DE"
 	case 0x02:
 		return "HL"
-	case 0x03:
-		return "SP"
 	default:
-		log.Fatal("Invalid register pair code")
-		return ""
+		return "SP"
 	}
 }
 
@@ -56,7 +48,7 @@ func OverflowingSub(x, y, cy uint8) (uint8, uint8) {
 
 func OverflowingAdd(x, y, cy uint8) (uint8, uint8) {
 	var carry uint8
-	if uint16(x)+uint16(y)+uint16(cy) >= 255 {
+	if uint16(x)+uint16(y)+uint16(cy) > 0xff {
 		carry = 1
 	}
 	return x + y + cy, carry